@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// acmeTimeout limits how long getting one certificate may take
+	acmeTimeout = 10 * time.Minute
+	// acmeCheckInterval is how often the certificate's expiry is checked
+	acmeCheckInterval = 12 * time.Hour
+	// acmeRetryInterval is how long to wait after a failed renewal
+	acmeRetryInterval = time.Hour
+	// acmeCleanUpTimeout limits how long removing a challenge record may
+	// take. The record is removed even if the order timed out or was
+	// cancelled, so it gets its own context.
+	acmeCleanUpTimeout = time.Minute
+)
+
+// Files in the ACME cache directory
+const (
+	acmeAccountKeyFile = "account.key"
+	acmeCertFile       = "cert.pem" // certificate followed by the chain
+	acmeKeyFile        = "key.pem"
+)
+
+var errNoCertificate = errors.New("no certificate yet")
+
+// CertManager gets certificates from an ACME server such as Let's Encrypt
+// and renews them before they expire. The server uses GetCertificate, so a
+// renewed certificate is used from the next TLS handshake on.
+type CertManager struct {
+	cfg     ACMEConfig
+	domains []string
+	dns     DNSProvider
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertManager returns a certificate manager for the ACME settings in
+// cfg, with the certificate from its cache directory loaded if there is one
+func NewCertManager(cfg Config) (*CertManager, error) {
+	provider, err := NewDNSProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.ACME.CacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating ACME cache directory: %v", err)
+	}
+
+	m := &CertManager{cfg: cfg.ACME, domains: cfg.acmeDomains(), dns: provider}
+	cert, err := tls.LoadX509KeyPair(m.cachePath(acmeCertFile), m.cachePath(acmeKeyFile))
+	if err == nil {
+		m.setCertificate(&cert)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Ignoring cached certificate: %v", err)
+	}
+	return m, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errNoCertificate
+	}
+	return m.cert, nil
+}
+
+// Run renews the certificate whenever it is due, checking every 12 hours,
+// until ctx is cancelled
+func (m *CertManager) Run(ctx context.Context) {
+	for {
+		wait := acmeCheckInterval
+		if err := m.renewIfDue(ctx); err != nil {
+			log.Printf("Error renewing certificate: %v", err)
+			wait = acmeRetryInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// renewIfDue gets a new certificate if there is none, it doesn't cover the
+// configured domains, or it expires within renew_days
+func (m *CertManager) renewIfDue(ctx context.Context) error {
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+
+	if cert != nil && coversDomains(cert.Leaf, m.domains) &&
+		time.Until(cert.Leaf.NotAfter) > time.Duration(m.cfg.RenewDays)*24*time.Hour {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+	log.Printf("Requesting a certificate for %s from %s", strings.Join(m.domains, ", "), m.cfg.DirectoryURL)
+	cert, err := m.obtain(ctx)
+	if err != nil {
+		return err
+	}
+	m.setCertificate(cert)
+	return nil
+}
+
+// setCertificate makes cert the one served
+func (m *CertManager) setCertificate(cert *tls.Certificate) {
+	if err := parseLeaf(cert); err != nil {
+		log.Print(err)
+		return
+	}
+	logCertificate(cert.Leaf)
+
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+}
+
+// obtain gets a new certificate, answering the DNS-01 challenge of every
+// domain, and stores it in the cache directory
+func (m *CertManager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	client, err := m.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.domains...))
+	if err != nil {
+		return nil, fmt.Errorf("error creating order: %v", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, authzURL); err != nil {
+			return nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for order: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.domains}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("error finalizing order: %v", err)
+	}
+
+	if err := m.saveCertificate(der, key); err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key}, nil
+}
+
+// authorize answers the DNS-01 challenge of one authorization
+func (m *CertManager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("error fetching authorization: %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+		}
+	}
+	domain := authz.Identifier.Value
+	if challenge == nil {
+		return fmt.Errorf("the ACME server offers no dns-01 challenge for %s", domain)
+	}
+
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+	if err := m.dns.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("error creating TXT record for %s: %v", domain, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), acmeCleanUpTimeout)
+		defer cancel()
+		if err := m.dns.CleanUp(ctx, fqdn, value); err != nil {
+			log.Printf("Error removing TXT record for %s: %v", domain, err)
+		}
+	}()
+
+	// Give the record time to reach the DNS servers the ACME server asks
+	select {
+	case <-time.After(time.Duration(m.cfg.PropagationSeconds) * time.Second):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("error accepting challenge for %s: %v", domain, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("error validating %s: %v", domain, err)
+	}
+	return nil
+}
+
+// client returns an ACME client with a registered account. The account key
+// is created on first use and kept in the cache directory.
+func (m *CertManager) client(ctx context.Context) (*acme.Client, error) {
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.cfg.DirectoryURL, UserAgent: "chore-tracker"}
+
+	if m.cfg.CAFile != "" {
+		pemData, err := os.ReadFile(m.cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates in %s", m.cfg.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	account := &acme.Account{}
+	if m.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + m.cfg.Email}
+	}
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("error registering ACME account: %v", err)
+	}
+	return client, nil
+}
+
+// accountKey loads the ACME account key, creating it if there is none
+func (m *CertManager) accountKey() (crypto.Signer, error) {
+	path := m.cachePath(acmeAccountKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no key in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// saveCertificate writes the certificate chain and its key to the cache
+func (m *CertManager) saveCertificate(der [][]byte, key *ecdsa.PrivateKey) error {
+	var chain []byte
+	for _, cert := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Should the server stop between the writes, the files don't match and
+	// NewCertManager ignores them, so a new certificate is fetched
+	if err := writeFileAtomic(m.cachePath(acmeKeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+	return writeFileAtomic(m.cachePath(acmeCertFile), chain)
+}
+
+func (m *CertManager) cachePath(name string) string {
+	return filepath.Join(m.cfg.CacheDir, name)
+}
+
+// coversDomains reports whether the certificate is valid for all domains
+func coversDomains(leaf *x509.Certificate, domains []string) bool {
+	for _, domain := range domains {
+		if leaf.VerifyHostname(domain) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic replaces the file at path with data, readable only by the
+// owner, so that readers never see a half written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of allowance transactions
+const (
+	AllowanceEarned = "earned"
+	AllowancePayout = "payout"
+)
+
+// maxAllowanceCatchUpWeeks limits how many missed weeks are credited at
+// once, and how old a chore approved late may be to still be paid for
+const maxAllowanceCatchUpWeeks = 8
+
+var (
+	errPayoutTooSmall = errors.New("payout is below the minimum payout")
+	errPayoutTooLarge = errors.New("payout exceeds the allowance balance")
+)
+
+// AllowanceSettings controls how a child's points turn into money.
+// Amounts are in cents of the configured currency.
+//
+// Points are spent once: the weekly allowance cashes in the points earned
+// that week and takes them off the balance, and points already spent on
+// rewards aren't paid for. Points the allowance doesn't take, above the
+// weekly cap or all of them at a rate of zero, stay saved for rewards.
+type AllowanceSettings struct {
+	UserID             int
+	CentsPerPoint      int
+	Currency           string
+	WeeklyCapCents     int // 0 means no cap
+	MinimumPayoutCents int
+}
+
+// defaultAllowanceSettings are used for children without their own settings
+func defaultAllowanceSettings(userID int) AllowanceSettings {
+	return AllowanceSettings{UserID: userID, CentsPerPoint: 10, Currency: "USD"}
+}
+
+// AllowanceFor returns the allowance in cents earned for the given points
+func (s AllowanceSettings) AllowanceFor(points int) int {
+	if points <= 0 {
+		return 0
+	}
+	cents := points * s.CentsPerPoint
+	if s.WeeklyCapCents > 0 && cents > s.WeeklyCapCents {
+		cents = s.WeeklyCapCents
+	}
+	return cents
+}
+
+// pointsToConvert returns how many of the points the weekly allowance turns
+// into money: all of them up to the weekly cap, or none at a rate of zero
+func (s AllowanceSettings) pointsToConvert(points int) int {
+	if points <= 0 || s.CentsPerPoint <= 0 {
+		return 0
+	}
+	if s.WeeklyCapCents > 0 {
+		if max := (s.WeeklyCapCents + s.CentsPerPoint - 1) / s.CentsPerPoint; points > max {
+			points = max
+		}
+	}
+	return points
+}
+
+// Format formats an amount in cents in the settings' currency
+func (s AllowanceSettings) Format(cents int) string {
+	return formatMoney(cents, s.Currency)
+}
+
+// AllowanceTransaction is an entry in a child's allowance account
+type AllowanceTransaction struct {
+	ID          int
+	UserID      int
+	AmountCents int
+	Kind        string
+	WeekStart   string
+	Points      int
+	Note        string
+	CreatedAt   time.Time
+}
+
+// GetAllowanceSettings returns the child's allowance settings, or the defaults
+func GetAllowanceSettings(db querier, userID int) (AllowanceSettings, error) {
+	s := AllowanceSettings{UserID: userID}
+	err := db.QueryRow(`
+		SELECT cents_per_point, currency, weekly_cap_cents, minimum_payout_cents
+		FROM allowance_settings WHERE user_id = ?
+	`, userID).Scan(&s.CentsPerPoint, &s.Currency, &s.WeeklyCapCents, &s.MinimumPayoutCents)
+	if err == sql.ErrNoRows {
+		return defaultAllowanceSettings(userID), nil
+	}
+	return s, err
+}
+
+// SaveAllowanceSettings creates or replaces the child's allowance settings
+func SaveAllowanceSettings(db *sql.DB, s AllowanceSettings) error {
+	_, err := db.Exec(`
+		INSERT INTO allowance_settings (user_id, cents_per_point, currency, weekly_cap_cents, minimum_payout_cents)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE
+		SET cents_per_point = excluded.cents_per_point, currency = excluded.currency,
+		    weekly_cap_cents = excluded.weekly_cap_cents, minimum_payout_cents = excluded.minimum_payout_cents
+	`, s.UserID, s.CentsPerPoint, s.Currency, s.WeeklyCapCents, s.MinimumPayoutCents)
+	return err
+}
+
+// GetAllowanceBalance returns the unpaid allowance of the child in cents
+func GetAllowanceBalance(db *sql.DB, userID int) (int, error) {
+	var balance int
+	err := db.QueryRow("SELECT IFNULL(SUM(amount_cents), 0) FROM allowance_transactions WHERE user_id = ?", userID).Scan(&balance)
+	return balance, err
+}
+
+// GetAllowanceHistory returns the child's allowance transactions, oldest first
+func GetAllowanceHistory(db *sql.DB, userID int) ([]AllowanceTransaction, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, amount_cents, kind, week_start, IFNULL(points, 0), IFNULL(note, ''), created_at
+		FROM allowance_transactions
+		WHERE user_id = ?
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []AllowanceTransaction
+	for rows.Next() {
+		var t AllowanceTransaction
+		var weekStart sql.NullTime
+		var createdAt int64
+		if err := rows.Scan(&t.ID, &t.UserID, &t.AmountCents, &t.Kind, &weekStart, &t.Points, &t.Note, &createdAt); err != nil {
+			return nil, err
+		}
+		if weekStart.Valid {
+			t.WeekStart = weekStart.Time.Format("2006-01-02")
+		}
+		t.CreatedAt = time.Unix(createdAt, 0).In(config.Location())
+		history = append(history, t)
+	}
+	return history, rows.Err()
+}
+
+// CreditWeeklyAllowance credits the allowance of every complete week up to
+// at that hasn't been credited yet, oldest first, so that weeks missed
+// while the server was down are caught up. It runs as the weekly_allowance
+// job, in the job's transaction.
+func CreditWeeklyAllowance(tx *sql.Tx, at time.Time) error {
+	last := lastCompleteWeek(at, config.FirstWeekday())
+
+	// Not MAX(week_start), which would come back as a string rather than a time
+	var credited time.Time
+	err := tx.QueryRow("SELECT week_start FROM allowance_weeks ORDER BY week_start DESC LIMIT 1").Scan(&credited)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	start := last
+	if err == nil {
+		start = time.Date(credited.Year(), credited.Month(), credited.Day()+7, 0, 0, 0, 0, last.Location())
+	}
+	if earliest := last.AddDate(0, 0, -7*(maxAllowanceCatchUpWeeks-1)); start.Before(earliest) {
+		log.Printf("Allowance not credited since %s, crediting only the last %d weeks", start.Format("2006-01-02"), maxAllowanceCatchUpWeeks)
+		start = earliest
+	}
+
+	for week := start; !week.After(last); week = week.AddDate(0, 0, 7) {
+		if err := creditAllowanceWeek(tx, week); err != nil {
+			return fmt.Errorf("week of %s: %v", week.Format("2006-01-02"), err)
+		}
+	}
+	return nil
+}
+
+// creditAllowanceWeek credits each child the allowance for the points
+// earned in the week starting at weekStart, or approved late for earlier
+// weeks, as far as they are still on the balance, takes the converted points off the balance and marks the week as
+// credited. A week is only ever credited once per child.
+func creditAllowanceWeek(tx *sql.Tx, weekStart time.Time) error {
+	children, err := getChildren(tx)
+	if err != nil {
+		return err
+	}
+
+	var lastTransactionID int
+	if err := tx.QueryRow("SELECT IFNULL(MAX(id), 0) FROM points_transactions").Scan(&lastTransactionID); err != nil {
+		return err
+	}
+
+	from := weekStart.Format("2006-01-02")
+	for _, child := range children {
+		earned, err := allowancePoints(tx, child.ID, weekStart)
+		if err != nil {
+			return err
+		}
+		balance, err := GetBalance(tx, child.ID)
+		if err != nil {
+			return err
+		}
+		settings, err := GetAllowanceSettings(tx, child.ID)
+		if err != nil {
+			return err
+		}
+		// Points already spent on rewards aren't on the balance any more
+		points := settings.pointsToConvert(min(earned, balance))
+		cents := settings.AllowanceFor(points)
+		if cents == 0 {
+			continue
+		}
+		res, err := tx.Exec(`
+			INSERT OR IGNORE INTO allowance_transactions (user_id, amount_cents, kind, week_start, points, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, child.ID, cents, AllowanceEarned, from, points, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue // credited before
+		}
+		err = recordPoints(tx, PointsTransaction{
+			UserID: child.ID,
+			Amount: -points,
+			Source: SourceAllowance,
+			Note:   "allowance for the week of " + from,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO allowance_weeks (week_start, credited_at, last_transaction_id) VALUES (?, ?, ?)
+	`, from, time.Now().Unix(), lastTransactionID)
+	return err
+}
+
+// allowancePoints returns the chore points the allowance of the week
+// starting at weekStart pays the child for: those of the week's chores, and
+// those credited for earlier chores after the allowance of their week was,
+// such as chores approved late. Earlier chores only count back to
+// maxAllowanceCatchUpWeeks.
+func allowancePoints(tx *sql.Tx, userID int, weekStart time.Time) (int, error) {
+	var points int
+	err := tx.QueryRow(`
+		SELECT IFNULL(SUM(pt.amount), 0)
+		FROM points_transactions pt
+		JOIN daily_chores dc ON pt.daily_chore_id = dc.id
+		WHERE pt.user_id = ? AND pt.source = ? AND dc.date BETWEEN ? AND ?
+			AND NOT EXISTS (
+				SELECT 1 FROM allowance_weeks aw
+				WHERE aw.week_start < ? AND aw.week_start >= date(dc.date, '-6 days')
+					AND pt.id <= aw.last_transaction_id
+			)
+	`, userID, SourceChore,
+		weekStart.AddDate(0, 0, -7*maxAllowanceCatchUpWeeks).Format("2006-01-02"),
+		weekStart.AddDate(0, 0, 6).Format("2006-01-02"),
+		weekStart.Format("2006-01-02")).Scan(&points)
+	return points, err
+}
+
+// RecordPayout records money paid out to the child by a parent. The balance
+// is checked by the insert itself, so two payouts at once can't overdraw.
+func RecordPayout(db *sql.DB, userID, cents, actorID int, note string) error {
+	settings, err := GetAllowanceSettings(db, userID)
+	if err != nil {
+		return err
+	}
+	if cents <= 0 || cents < settings.MinimumPayoutCents {
+		return errPayoutTooSmall
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO allowance_transactions (user_id, amount_cents, kind, actor_id, note, created_at)
+		SELECT ?, ?, ?, ?, ?, ?
+		WHERE (SELECT IFNULL(SUM(amount_cents), 0) FROM allowance_transactions WHERE user_id = ?) >= ?
+	`, userID, -cents, AllowancePayout, actorID, note, time.Now().Unix(), userID, cents)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = errPayoutTooLarge
+	}
+	return err
+}
+
+// activeChild returns the user if it is a child that isn't archived
+func activeChild(db *sql.DB, userID int) (*User, error) {
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Role != RoleChild || user.Archived {
+		return nil, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+// getChildren returns all users with the child role that aren't archived
+func getChildren(db querier) ([]User, error) {
+	rows, err := db.Query("SELECT id, username, email, role FROM users WHERE role = ? AND archived_at IS NULL ORDER BY username", RoleChild)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var children []User
+	for rows.Next() {
+		var child User
+		if err := rows.Scan(&child.ID, &child.Username, &child.Email, &child.Role); err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
+
+// formatMoney formats an amount in cents, e.g. "USD 12.50"
+func formatMoney(cents int, currency string) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s %s%d.%02d", currency, sign, cents/100, cents%100)
+}
+
+// parseMoney parses an amount such as "12", "12.5" or "12.50" into cents
+func parseMoney(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	w, err := strconv.Atoi(whole)
+	if err != nil || w < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	f, err := strconv.Atoi(frac)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return w*100 + f, nil
+}
+
+// allowanceHandler shows the allowance accounts: children see their own,
+// parents see every child's with forms to change settings and pay out
+func allowanceHandler(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	var children []User
+	if user.Role == RoleParent {
+		var err error
+		children, err = getChildren(db)
+		if err != nil {
+			log.Printf("Error fetching children: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		children = []User{*user}
+	}
+
+	type historyLine struct {
+		Date    string
+		Kind    string
+		Detail  string
+		Amount  string
+		Balance string
+	}
+	type account struct {
+		User          User
+		Settings      AllowanceSettings
+		Rate          string
+		WeeklyCap     string
+		MinimumPayout string
+		Balance       string
+		History       []historyLine
+	}
+
+	var accounts []account
+	for _, child := range children {
+		settings, err := GetAllowanceSettings(db, child.ID)
+		if err != nil {
+			log.Printf("Error fetching allowance settings: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history, err := GetAllowanceHistory(db, child.ID)
+		if err != nil {
+			log.Printf("Error fetching allowance history: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		acc := account{
+			User:          child,
+			Settings:      settings,
+			Rate:          fmt.Sprintf("%d.%02d", settings.CentsPerPoint/100, settings.CentsPerPoint%100),
+			WeeklyCap:     fmt.Sprintf("%d.%02d", settings.WeeklyCapCents/100, settings.WeeklyCapCents%100),
+			MinimumPayout: fmt.Sprintf("%d.%02d", settings.MinimumPayoutCents/100, settings.MinimumPayoutCents%100),
+		}
+		balance := 0
+		for _, t := range history {
+			balance += t.AmountCents
+			detail := t.Note
+			if t.Kind == AllowanceEarned {
+				detail = fmt.Sprintf("%d points in the week of %s", t.Points, t.WeekStart)
+			}
+			acc.History = append(acc.History, historyLine{
+				Date:    t.CreatedAt.Format("2006-01-02"),
+				Kind:    t.Kind,
+				Detail:  detail,
+				Amount:  settings.Format(t.AmountCents),
+				Balance: settings.Format(balance),
+			})
+		}
+		acc.Balance = settings.Format(balance)
+		accounts = append(accounts, acc)
+	}
+
+	data := struct {
+		IsParent bool
+		Accounts []account
+	}{
+		IsParent: user.Role == RoleParent,
+		Accounts: accounts,
+	}
+	templates.ExecuteTemplate(w, "allowance.html", data)
+}
+
+// allowanceSettingsHandler saves a child's allowance settings
+func allowanceSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := activeChild(db, userID); err != nil {
+		http.Error(w, "Allowance settings are for children only", http.StatusBadRequest)
+		return
+	}
+	rate, err := parseMoney(r.FormValue("rate"))
+	if err != nil {
+		http.Error(w, "Invalid rate", http.StatusBadRequest)
+		return
+	}
+	weeklyCap, err := parseMoney(r.FormValue("weekly_cap"))
+	if err != nil {
+		http.Error(w, "Invalid weekly cap", http.StatusBadRequest)
+		return
+	}
+	minimum, err := parseMoney(r.FormValue("minimum_payout"))
+	if err != nil {
+		http.Error(w, "Invalid minimum payout", http.StatusBadRequest)
+		return
+	}
+	currency := strings.ToUpper(strings.TrimSpace(r.FormValue("currency")))
+	if currency == "" {
+		http.Error(w, "Invalid currency", http.StatusBadRequest)
+		return
+	}
+
+	err = SaveAllowanceSettings(db, AllowanceSettings{
+		UserID:             userID,
+		CentsPerPoint:      rate,
+		Currency:           currency,
+		WeeklyCapCents:     weeklyCap,
+		MinimumPayoutCents: minimum,
+	})
+	if err != nil {
+		log.Printf("Error saving allowance settings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/allowance", http.StatusFound)
+}
+
+// allowancePayoutHandler records a payout to a child
+func allowancePayoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := activeChild(db, userID); err != nil {
+		http.Error(w, "Allowance is paid out to children only", http.StatusBadRequest)
+		return
+	}
+	cents, err := parseMoney(r.FormValue("amount"))
+	if err != nil {
+		http.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+
+	err = RecordPayout(db, userID, cents, user.ID, r.FormValue("note"))
+	if err == errPayoutTooSmall || err == errPayoutTooLarge {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording payout: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/allowance", http.StatusFound)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// addApprovedChore creates a chore the child did on date and has the parent
+// approve it, and returns the daily chore's ID
+func addApprovedChore(t *testing.T, db *sql.DB, childID, parentID int, date string, points int) int {
+	t.Helper()
+	result, err := db.Exec(`
+		INSERT INTO chores (name, points, default_user_id) VALUES (?, ?, ?)
+	`, fmt.Sprintf("chore of %d on %s", childID, date), points, childID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	choreID, _ := result.LastInsertId()
+	result, err = db.Exec(`
+		INSERT INTO daily_chores (user_id, chore_id, date, completed, status) VALUES (?, ?, ?, TRUE, ?)
+	`, childID, choreID, date, StatusPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dailyChoreID, _ := result.LastInsertId()
+	if err := ApproveChore(db, int(dailyChoreID), parentID); err != nil {
+		t.Fatal(err)
+	}
+	return int(dailyChoreID)
+}
+
+// creditAllowance runs the weekly_allowance job for the time at
+func creditAllowance(t *testing.T, db *sql.DB, at time.Time) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := CreditWeeklyAllowance(tx, at); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type earnedAllowance struct {
+	cents, points int
+}
+
+// earnedAllowances returns the child's earned allowance by week
+func earnedAllowances(t *testing.T, db *sql.DB, childID int) map[string]earnedAllowance {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT week_start, amount_cents, points FROM allowance_transactions
+		WHERE user_id = ? AND kind = ?
+	`, childID, AllowanceEarned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	earned := make(map[string]earnedAllowance)
+	for rows.Next() {
+		var week time.Time
+		var e earnedAllowance
+		if err := rows.Scan(&week, &e.cents, &e.points); err != nil {
+			t.Fatal(err)
+		}
+		earned[week.Format("2006-01-02")] = e
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return earned
+}
+
+// testWeek returns the first day of the nth week of the tests, its nth day
+// and when the week's jobs run
+func testWeek(n int) (start time.Time, day func(int) string, end time.Time) {
+	start = weekStartOf(time.Date(2026, 10, 7, 0, 0, 0, 0, config.Location()), config.FirstWeekday()).AddDate(0, 0, 7*(n-1))
+	day = func(i int) string { return start.AddDate(0, 0, i).Format("2006-01-02") }
+	end = start.AddDate(0, 0, 6).Add(23*time.Hour + 59*time.Minute)
+	return start, day, end
+}
+
+func TestCreditWeeklyAllowanceCreditsWeekOnce(t *testing.T) {
+	db := newTestDB(t)
+	parent := addTestUser(t, db, "parent", RoleParent)
+	child := addTestUser(t, db, "child", RoleChild)
+	start, day, end := testWeek(1)
+	addApprovedChore(t, db, child, parent, day(1), 4)
+	addApprovedChore(t, db, child, parent, day(3), 6)
+
+	creditAllowance(t, db, end)
+	creditAllowance(t, db, end)
+	creditAllowance(t, db, end.Add(30*time.Minute)) // run late, after midnight
+
+	want := map[string]earnedAllowance{start.Format("2006-01-02"): {cents: 100, points: 10}}
+	if got := earnedAllowances(t, db, child); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("earned allowance %v, want %v", got, want)
+	}
+	if got := mustBalance(t, db, child); got != 0 {
+		t.Errorf("balance %d after crediting, want 0", got)
+	}
+}
+
+func TestCreditWeeklyAllowancePaysLateApprovalsNextWeek(t *testing.T) {
+	db := newTestDB(t)
+	parent := addTestUser(t, db, "parent", RoleParent)
+	child := addTestUser(t, db, "child", RoleChild)
+	week1, day1, end1 := testWeek(1)
+	week2, day2, end2 := testWeek(2)
+	_, _, end3 := testWeek(3)
+
+	addApprovedChore(t, db, child, parent, day1(0), 4)
+	creditAllowance(t, db, end1)
+
+	// Approved after the first week was paid
+	addApprovedChore(t, db, child, parent, day1(5), 6)
+	addApprovedChore(t, db, child, parent, day2(2), 3)
+	creditAllowance(t, db, end2)
+	creditAllowance(t, db, end3)
+
+	want := map[string]earnedAllowance{
+		week1.Format("2006-01-02"): {cents: 40, points: 4},
+		week2.Format("2006-01-02"): {cents: 90, points: 9},
+	}
+	if got := earnedAllowances(t, db, child); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("earned allowance %v, want %v", got, want)
+	}
+	if got := mustBalance(t, db, child); got != 0 {
+		t.Errorf("balance %d after crediting, want 0", got)
+	}
+}
+
+func TestCreditWeeklyAllowanceCatchesUpMissedWeeks(t *testing.T) {
+	db := newTestDB(t)
+	parent := addTestUser(t, db, "parent", RoleParent)
+	child := addTestUser(t, db, "child", RoleChild)
+	week1, day1, end1 := testWeek(1)
+	week2, day2, _ := testWeek(2)
+	week3, day3, end3 := testWeek(3)
+
+	addApprovedChore(t, db, child, parent, day1(0), 1)
+	creditAllowance(t, db, end1)
+	addApprovedChore(t, db, child, parent, day2(0), 2)
+	addApprovedChore(t, db, child, parent, day3(0), 3)
+	creditAllowance(t, db, end3) // the second week's run was missed
+
+	want := map[string]earnedAllowance{
+		week1.Format("2006-01-02"): {cents: 10, points: 1},
+		week2.Format("2006-01-02"): {cents: 20, points: 2},
+		week3.Format("2006-01-02"): {cents: 30, points: 3},
+	}
+	if got := earnedAllowances(t, db, child); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("earned allowance %v, want %v", got, want)
+	}
+}
+
+func TestCreditWeeklyAllowanceSpendsPointsOnce(t *testing.T) {
+	db := newTestDB(t)
+	parent := addTestUser(t, db, "parent", RoleParent)
+	spender := addTestUser(t, db, "spender", RoleChild)
+	capped := addTestUser(t, db, "capped", RoleChild)
+	saver := addTestUser(t, db, "saver", RoleChild)
+	start, day, end := testWeek(1)
+	week := start.Format("2006-01-02")
+
+	for _, s := range []AllowanceSettings{
+		{UserID: capped, CentsPerPoint: 10, Currency: "USD", WeeklyCapCents: 50},
+		{UserID: saver, CentsPerPoint: 0, Currency: "USD"},
+	} {
+		if err := SaveAllowanceSettings(db, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, child := range []int{spender, capped, saver} {
+		addApprovedChore(t, db, child, parent, day(2), 10)
+	}
+	if err := recordPoints(db, PointsTransaction{UserID: spender, Amount: -4, Source: SourceReward}); err != nil {
+		t.Fatal(err)
+	}
+
+	creditAllowance(t, db, end)
+
+	tests := []struct {
+		name    string
+		child   int
+		earned  map[string]earnedAllowance
+		balance int
+	}{
+		{"reward bought before", spender, map[string]earnedAllowance{week: {60, 6}}, 0},
+		{"weekly cap", capped, map[string]earnedAllowance{week: {50, 5}}, 5},
+		{"rate of zero", saver, map[string]earnedAllowance{}, 10},
+	}
+	for _, tt := range tests {
+		if got := earnedAllowances(t, db, tt.child); fmt.Sprint(got) != fmt.Sprint(tt.earned) {
+			t.Errorf("%s: earned allowance %v, want %v", tt.name, got, tt.earned)
+		}
+		if got := mustBalance(t, db, tt.child); got != tt.balance {
+			t.Errorf("%s: balance %d, want %d", tt.name, got, tt.balance)
+		}
+	}
+}
+
+func TestPointsToConvert(t *testing.T) {
+	tests := []struct {
+		settings AllowanceSettings
+		points   int
+		want     int
+		cents    int
+	}{
+		{AllowanceSettings{CentsPerPoint: 10}, 7, 7, 70},
+		{AllowanceSettings{CentsPerPoint: 10}, 0, 0, 0},
+		{AllowanceSettings{CentsPerPoint: 10}, -3, 0, 0},
+		{AllowanceSettings{CentsPerPoint: 10, WeeklyCapCents: 50}, 7, 5, 50},
+		{AllowanceSettings{CentsPerPoint: 10, WeeklyCapCents: 55}, 7, 6, 55},
+		{AllowanceSettings{CentsPerPoint: 10, WeeklyCapCents: 500}, 7, 7, 70},
+		{AllowanceSettings{CentsPerPoint: 0}, 7, 0, 0},
+	}
+	for _, tt := range tests {
+		got := tt.settings.pointsToConvert(tt.points)
+		if got != tt.want {
+			t.Errorf("%+v: pointsToConvert(%d) = %d, want %d", tt.settings, tt.points, got, tt.want)
+		}
+		if cents := tt.settings.AllowanceFor(got); cents != tt.cents {
+			t.Errorf("%+v: AllowanceFor(%d) = %d, want %d", tt.settings, got, cents, tt.cents)
+		}
+	}
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// The JSON API lives under /api/v1. Every response is JSON; errors are
+// {"error": "..."} with a matching status code. Anyone logged in can read,
+// changes are up to parents, except that users can change their own email
+// and password and tick off their own chores. Scripts authenticate with API
+// tokens, which can be restricted further, see scopeAllows.
+
+const apiPrefix = "/api/v1/"
+
+type apiUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+	Role     string `json:"role"`
+	Points   int    `json:"points"`
+	Archived bool   `json:"archived"`
+}
+
+type apiUserRequest struct {
+	Username *string `json:"username"`
+	Password *string `json:"password"`
+	Email    *string `json:"email"`
+	Role     *string `json:"role"`
+	Archived *bool   `json:"archived"`
+}
+
+type apiChore struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Points        int    `json:"points"`
+	DefaultUserID *int   `json:"default_user_id"`
+	Recurrence    string `json:"recurrence"`
+	Archived      bool   `json:"archived"`
+}
+
+type apiChoreRequest struct {
+	Name          *string `json:"name"`
+	Points        *int    `json:"points"`
+	DefaultUserID *int    `json:"default_user_id"`
+	Recurrence    *string `json:"recurrence"`
+	Archived      *bool   `json:"archived"`
+}
+
+type apiDailyChore struct {
+	ID         int    `json:"id"`
+	UserID     int    `json:"user_id"`
+	ChoreID    int    `json:"chore_id"`
+	Date       string `json:"date"`
+	Completed  bool   `json:"completed"`
+	Status     string `json:"status"`
+	ReviewNote string `json:"review_note,omitempty"`
+}
+
+type apiDailyChoreRequest struct {
+	UserID    *int    `json:"user_id"`
+	ChoreID   *int    `json:"chore_id"`
+	Date      *string `json:"date"`
+	Completed *bool   `json:"completed"`
+}
+
+// apiHandler wraps an API handler so that it is only called for logged in
+// users or valid tokens whose scope allows the request. The handler gets
+// the user and the ID from the path, 0 for collection URLs.
+func apiHandler(resource string, next func(w http.ResponseWriter, r *http.Request, user *User, id int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, scope := authenticateAPI(w, r)
+		if user == nil {
+			return
+		}
+
+		id := 0
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix+resource), "/")
+		if rest != "" {
+			var err error
+			id, err = strconv.Atoi(rest)
+			if err != nil || id <= 0 {
+				writeAPIError(w, http.StatusNotFound, "not found")
+				return
+			}
+		}
+		if !scopeAllows(scope, resource, r.Method, id) {
+			writeAPIError(w, http.StatusForbidden, "the token's scope is "+scope)
+			return
+		}
+		next(w, withAPIScope(r, scope), user, id)
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding API response: %v", err)
+	}
+}
+
+// writeAPIError writes an API error response
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeAPIServerError logs an unexpected error and writes a 500 response,
+// or a 404 response for sql.ErrNoRows
+func writeAPIServerError(w http.ResponseWriter, err error, context string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeAPIError(w, http.StatusNotFound, "not found")
+	case isUniqueViolation(err):
+		writeAPIError(w, http.StatusConflict, "already exists")
+	case err == errLastParent:
+		writeAPIError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("Error %s: %v", context, err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// writeMethodNotAllowed writes a 405 response listing the allowed methods
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// readJSON decodes the request body into v, writing a 400 response on failure
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+func toAPIUser(u User, viewer *User) apiUser {
+	out := apiUser{ID: u.ID, Username: u.Username, Role: u.Role, Points: u.Points, Archived: u.Archived}
+	if viewer.Role == RoleParent || viewer.ID == u.ID {
+		out.Email = u.Email
+	}
+	return out
+}
+
+func toAPIChore(c Chore) apiChore {
+	out := apiChore{ID: c.ID, Name: c.Name, Points: c.Points, Recurrence: c.Recurrence.String(), Archived: c.Archived}
+	if c.DefaultUserID != 0 {
+		id := c.DefaultUserID
+		out.DefaultUserID = &id
+	}
+	return out
+}
+
+func toAPIDailyChore(dc DailyChore) apiDailyChore {
+	return apiDailyChore(dc)
+}
+
+// activeUser returns the user with the given ID unless they are archived
+func activeUser(id int) (*User, error) {
+	u, err := GetUserByID(db, id)
+	if err == nil && u.Archived {
+		err = sql.ErrNoRows
+	}
+	return u, err
+}
+
+// apiUsersHandler serves /api/v1/users and /api/v1/users/{id}
+func apiUsersHandler(w http.ResponseWriter, r *http.Request, user *User, id int) {
+	switch {
+	case id == 0 && r.Method == "GET":
+		users, err := GetUsers(db)
+		if err != nil {
+			writeAPIServerError(w, err, "listing users")
+			return
+		}
+		out := []apiUser{}
+		for _, u := range users {
+			out = append(out, toAPIUser(u, user))
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case id == 0 && r.Method == "POST":
+		if user.Role != RoleParent {
+			writeAPIError(w, http.StatusForbidden, "only parents can add users")
+			return
+		}
+		var req apiUserRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Username == nil || req.Password == nil || req.Email == nil || req.Role == nil ||
+			*req.Username == "" || *req.Password == "" {
+			writeAPIError(w, http.StatusBadRequest, "username, password, email and role are required")
+			return
+		}
+		if !validRole(*req.Role) {
+			writeAPIError(w, http.StatusBadRequest, "invalid role")
+			return
+		}
+		if err := CreateUser(db, *req.Username, *req.Password, *req.Email, *req.Role); err != nil {
+			writeAPIServerError(w, err, "creating user")
+			return
+		}
+		created, err := GetUserByUsername(db, *req.Username)
+		if err != nil {
+			writeAPIServerError(w, err, "fetching user")
+			return
+		}
+		writeJSON(w, http.StatusCreated, toAPIUser(*created, user))
+
+	case id != 0 && r.Method == "GET":
+		u, err := GetUserByID(db, id)
+		if err != nil {
+			writeAPIServerError(w, err, "fetching user")
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIUser(*u, user))
+
+	case id != 0 && (r.Method == "PUT" || r.Method == "PATCH"):
+		apiUpdateUser(w, r, user, id)
+
+	case id != 0 && r.Method == "DELETE":
+		if user.Role != RoleParent {
+			writeAPIError(w, http.StatusForbidden, "only parents can delete users")
+			return
+		}
+		if id == user.ID {
+			writeAPIError(w, http.StatusConflict, "you can't delete yourself")
+			return
+		}
+		if err := checkOtherParents(db, id); err != nil {
+			writeAPIServerError(w, err, "counting parents")
+			return
+		}
+		// Users with a history are archived instead
+		if _, err := RemoveUser(db, id); err != nil {
+			writeAPIServerError(w, err, "deleting user")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case id == 0:
+		writeMethodNotAllowed(w, "GET", "POST")
+	default:
+		writeMethodNotAllowed(w, "GET", "PUT", "PATCH", "DELETE")
+	}
+}
+
+// apiUpdateUser changes the fields given in the request. Users may change
+// their own email and password, everything else is up to parents.
+func apiUpdateUser(w http.ResponseWriter, r *http.Request, user *User, id int) {
+	var req apiUserRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if user.Role != RoleParent && (id != user.ID || req.Username != nil || req.Role != nil || req.Archived != nil) {
+		writeAPIError(w, http.StatusForbidden, "you can only change your own email and password")
+		return
+	}
+
+	target, err := GetUserByID(db, id)
+	if err != nil {
+		writeAPIServerError(w, err, "fetching user")
+		return
+	}
+	oldRole := target.Role
+	if req.Username != nil {
+		if *req.Username == "" {
+			writeAPIError(w, http.StatusBadRequest, "username can't be empty")
+			return
+		}
+		target.Username = *req.Username
+	}
+	if req.Email != nil {
+		target.Email = *req.Email
+	}
+	if req.Role != nil {
+		if !validRole(*req.Role) {
+			writeAPIError(w, http.StatusBadRequest, "invalid role")
+			return
+		}
+		target.Role = *req.Role
+	}
+	password := ""
+	if req.Password != nil {
+		if *req.Password == "" {
+			writeAPIError(w, http.StatusBadRequest, "password can't be empty")
+			return
+		}
+		password = *req.Password
+	}
+
+	archive := req.Archived != nil && *req.Archived && !target.Archived
+	if archive && id == user.ID {
+		writeAPIError(w, http.StatusConflict, "you can't archive yourself")
+		return
+	}
+	if oldRole == RoleParent && (target.Role != RoleParent || archive) {
+		if err := checkOtherParents(db, id); err != nil {
+			writeAPIServerError(w, err, "counting parents")
+			return
+		}
+	}
+
+	if err := UpdateUser(db, target, password); err != nil {
+		writeAPIServerError(w, err, "updating user")
+		return
+	}
+	if req.Archived != nil && *req.Archived != target.Archived {
+		if *req.Archived {
+			err = ArchiveUser(db, id)
+		} else {
+			err = RestoreUser(db, id)
+		}
+		if err != nil {
+			writeAPIServerError(w, err, "archiving user")
+			return
+		}
+		target.Archived = *req.Archived
+		if err := AssignDueChores(db, householdNow()); err != nil {
+			log.Printf("Error assigning due chores: %v", err)
+		}
+	}
+	if target.Role != oldRole || password != "" {
+		// Sessions were granted for the old role or password
+		if err := RevokeUserSessions(db, target.ID); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, toAPIUser(*target, user))
+}
+
+// apiChoresHandler serves /api/v1/chores and /api/v1/chores/{id}
+func apiChoresHandler(w http.ResponseWriter, r *http.Request, user *User, id int) {
+	if r.Method != "GET" && user.Role != RoleParent {
+		writeAPIError(w, http.StatusForbidden, "only parents can change chores")
+		return
+	}
+
+	switch {
+	case id == 0 && r.Method == "GET":
+		chores, err := GetChores(db)
+		if err != nil {
+			writeAPIServerError(w, err, "listing chores")
+			return
+		}
+		out := []apiChore{}
+		for _, c := range chores {
+			out = append(out, toAPIChore(c))
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case id == 0 && r.Method == "POST":
+		var req apiChoreRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Name == nil || *req.Name == "" || req.Points == nil || req.DefaultUserID == nil {
+			writeAPIError(w, http.StatusBadRequest, "name, points and default_user_id are required")
+			return
+		}
+		chore := Chore{Name: *req.Name}
+		if !applyChoreRequest(w, &chore, req) {
+			return
+		}
+		if err := CreateChore(db, chore.Name, chore.Points, chore.DefaultUserID, chore.Recurrence); err != nil {
+			writeAPIServerError(w, err, "creating chore")
+			return
+		}
+		if err := AssignDueChores(db, householdNow()); err != nil {
+			log.Printf("Error assigning due chores: %v", err)
+		}
+		var newID int
+		if err := db.QueryRow("SELECT id FROM chores WHERE name = ?", chore.Name).Scan(&newID); err != nil {
+			writeAPIServerError(w, err, "fetching chore")
+			return
+		}
+		chore.ID = newID
+		writeJSON(w, http.StatusCreated, toAPIChore(chore))
+
+	case id != 0 && r.Method == "GET":
+		chore, err := GetChore(db, id)
+		if err != nil {
+			writeAPIServerError(w, err, "fetching chore")
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIChore(*chore))
+
+	case id != 0 && (r.Method == "PUT" || r.Method == "PATCH"):
+		chore, err := GetChore(db, id)
+		if err != nil {
+			writeAPIServerError(w, err, "fetching chore")
+			return
+		}
+		var req apiChoreRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Name != nil {
+			if *req.Name == "" {
+				writeAPIError(w, http.StatusBadRequest, "name can't be empty")
+				return
+			}
+			chore.Name = *req.Name
+		}
+		if !applyChoreRequest(w, chore, req) {
+			return
+		}
+		if err := UpdateChore(db, *chore); err != nil {
+			writeAPIServerError(w, err, "updating chore")
+			return
+		}
+		if req.Archived != nil && *req.Archived != chore.Archived {
+			if *req.Archived {
+				err = ArchiveChore(db, id)
+			} else {
+				err = RestoreChore(db, id)
+			}
+			if err != nil {
+				writeAPIServerError(w, err, "archiving chore")
+				return
+			}
+			chore.Archived = *req.Archived
+		}
+		if err := AssignDueChores(db, householdNow()); err != nil {
+			log.Printf("Error assigning due chores: %v", err)
+		}
+		writeJSON(w, http.StatusOK, toAPIChore(*chore))
+
+	case id != 0 && r.Method == "DELETE":
+		// Chores that have been assigned before are archived instead
+		if _, err := RemoveChore(db, id); err != nil {
+			writeAPIServerError(w, err, "deleting chore")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case id == 0:
+		writeMethodNotAllowed(w, "GET", "POST")
+	default:
+		writeMethodNotAllowed(w, "GET", "PUT", "PATCH", "DELETE")
+	}
+}
+
+// applyChoreRequest copies points, default user and recurrence from the
+// request into the chore, writing a 400 response if one is invalid
+func applyChoreRequest(w http.ResponseWriter, chore *Chore, req apiChoreRequest) bool {
+	if req.Points != nil {
+		if *req.Points < 0 {
+			writeAPIError(w, http.StatusBadRequest, "points can't be negative")
+			return false
+		}
+		chore.Points = *req.Points
+	}
+	if req.DefaultUserID != nil {
+		if !validDefaultUser(*req.DefaultUserID) {
+			writeAPIError(w, http.StatusBadRequest, "unknown default_user_id")
+			return false
+		}
+		chore.DefaultUserID = *req.DefaultUserID
+	}
+	if req.Recurrence != nil {
+		rec, err := ParseRecurrence(*req.Recurrence)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+		chore.Recurrence = rec
+	} else if chore.Recurrence.Kind == "" {
+		chore.Recurrence = Recurrence{Kind: RecurDaily}
+	}
+	return true
+}
+
+// apiDailyChoresHandler serves /api/v1/daily_chores and
+// /api/v1/daily_chores/{id}. Lists can be filtered with ?date= and
+// ?user_id=; children only see their own chores.
+func apiDailyChoresHandler(w http.ResponseWriter, r *http.Request, user *User, id int) {
+	switch {
+	case id == 0 && r.Method == "GET":
+		userID := 0
+		if s := r.URL.Query().Get("user_id"); s != "" {
+			var err error
+			if userID, err = strconv.Atoi(s); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid user_id")
+				return
+			}
+		}
+		if user.Role != RoleParent {
+			userID = user.ID
+		}
+		date := r.URL.Query().Get("date")
+		if date == "today" {
+			date = householdToday()
+		}
+		if date != "" && !validDate(date) {
+			writeAPIError(w, http.StatusBadRequest, "invalid date, use YYYY-MM-DD")
+			return
+		}
+		dailyChores, err := GetDailyChores(db, userID, date)
+		if err != nil {
+			writeAPIServerError(w, err, "listing daily chores")
+			return
+		}
+		out := []apiDailyChore{}
+		for _, dc := range dailyChores {
+			out = append(out, toAPIDailyChore(dc))
+		}
+		writeJSON(w, http.StatusOK, out)
+
+	case id == 0 && r.Method == "POST":
+		if user.Role != RoleParent {
+			writeAPIError(w, http.StatusForbidden, "only parents can assign chores")
+			return
+		}
+		var req apiDailyChoreRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.UserID == nil || req.ChoreID == nil {
+			writeAPIError(w, http.StatusBadRequest, "user_id and chore_id are required")
+			return
+		}
+		date := householdToday()
+		if req.Date != nil {
+			date = *req.Date
+		}
+		if !validDate(date) {
+			writeAPIError(w, http.StatusBadRequest, "invalid date, use YYYY-MM-DD")
+			return
+		}
+		if _, err := activeUser(*req.UserID); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "unknown user_id")
+			return
+		}
+		if chore, err := GetChore(db, *req.ChoreID); err != nil || chore.Archived {
+			writeAPIError(w, http.StatusBadRequest, "unknown chore_id")
+			return
+		}
+		if err := AssignChoreToUser(db, *req.UserID, *req.ChoreID, date); err != nil {
+			if isUniqueViolation(err) {
+				writeAPIError(w, http.StatusConflict, "chore is already assigned on that date")
+				return
+			}
+			writeAPIServerError(w, err, "assigning chore")
+			return
+		}
+		var newID int
+		err := db.QueryRow("SELECT id FROM daily_chores WHERE chore_id = ? AND date = ?", *req.ChoreID, date).Scan(&newID)
+		if err != nil {
+			writeAPIServerError(w, err, "fetching daily chore")
+			return
+		}
+		dc, err := GetDailyChore(db, newID)
+		if err != nil {
+			writeAPIServerError(w, err, "fetching daily chore")
+			return
+		}
+		writeJSON(w, http.StatusCreated, toAPIDailyChore(*dc))
+
+	case id != 0 && r.Method == "GET":
+		dc, err := GetDailyChore(db, id)
+		if err == nil && user.Role != RoleParent && dc.UserID != user.ID {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			writeAPIServerError(w, err, "fetching daily chore")
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIDailyChore(*dc))
+
+	case id != 0 && (r.Method == "PUT" || r.Method == "PATCH"):
+		apiUpdateDailyChore(w, r, user, id)
+
+	case id != 0 && r.Method == "DELETE":
+		if user.Role != RoleParent {
+			writeAPIError(w, http.StatusForbidden, "only parents can remove assignments")
+			return
+		}
+		err := DeleteDailyChore(db, id)
+		if err == errChoreAlreadyCompleted {
+			writeAPIError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIServerError(w, err, "deleting daily chore")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case id == 0:
+		writeMethodNotAllowed(w, "GET", "POST")
+	default:
+		writeMethodNotAllowed(w, "GET", "PUT", "PATCH", "DELETE")
+	}
+}
+
+// apiUpdateDailyChore reassigns a daily chore (parents) or marks it as
+// (un)done (the user it is assigned to, or a parent)
+func apiUpdateDailyChore(w http.ResponseWriter, r *http.Request, user *User, id int) {
+	dc, err := GetDailyChore(db, id)
+	if err == nil && user.Role != RoleParent && dc.UserID != user.ID {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		writeAPIServerError(w, err, "fetching daily chore")
+		return
+	}
+
+	var req apiDailyChoreRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.ChoreID != nil && *req.ChoreID != dc.ChoreID {
+		writeAPIError(w, http.StatusBadRequest, "chore_id can't be changed")
+		return
+	}
+
+	if req.UserID != nil || req.Date != nil {
+		if user.Role != RoleParent || apiScope(r) != ScopeFull {
+			writeAPIError(w, http.StatusForbidden, "only parents with full access can reassign chores")
+			return
+		}
+		userID, date := dc.UserID, dc.Date
+		if req.UserID != nil {
+			if _, err := activeUser(*req.UserID); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "unknown user_id")
+				return
+			}
+			userID = *req.UserID
+		}
+		if req.Date != nil {
+			if !validDate(*req.Date) {
+				writeAPIError(w, http.StatusBadRequest, "invalid date, use YYYY-MM-DD")
+				return
+			}
+			date = *req.Date
+		}
+		err := ReassignDailyChore(db, id, userID, date)
+		if err == errChoreAlreadyCompleted {
+			writeAPIError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIServerError(w, err, "reassigning daily chore")
+			return
+		}
+		dc.UserID, dc.Date = userID, date
+	}
+
+	if req.Completed != nil {
+		// Parents can tick off or undo chores for the child they are
+		// assigned to; ticking one off approves it
+		assignee := user
+		if dc.UserID != user.ID {
+			if assignee, err = GetUserByID(db, dc.UserID); err != nil {
+				writeAPIServerError(w, err, "fetching assigned user")
+				return
+			}
+		}
+		err := MarkChoreCompleted(db, user, assignee, dc.ChoreID, dc.Date, *req.Completed)
+		if err == errChoreAlreadyApproved {
+			writeAPIError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIServerError(w, err, "updating chore completion")
+			return
+		}
+		if *req.Completed {
+			if err := QueueChoreCompleted(db, assignee, dc.ChoreID, dc.Date); err != nil {
+				log.Printf("Error queueing chore completed notification: %v", err)
+			}
+		}
+	}
+
+	updated, err := GetDailyChore(db, id)
+	if err != nil {
+		writeAPIServerError(w, err, "fetching daily chore")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIDailyChore(*updated))
+}
+
+// validDate reports whether s is a date formatted as 2006-01-02
+func validDate(s string) bool {
+	_, err := time.Parse("2006-01-02", s)
+	return err == nil
+}
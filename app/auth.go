@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// User roles
+const (
+	RoleParent = "parent"
+	RoleChild  = "child"
+)
+
+// errLastParent is returned when a change would leave no parent to manage
+// the household
+var errLastParent = errors.New("there has to be at least one parent")
+
+// validRole reports whether role is one of the known user roles
+func validRole(role string) bool {
+	return role == RoleParent || role == RoleChild
+}
+
+// hasRole reports whether the user has one of the given roles
+func hasRole(user *User, roles ...string) bool {
+	for _, role := range roles {
+		if user.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRole wraps a handler so that only logged in users with one of the
+// given roles reach it. Anonymous users are sent to the login page, users
+// with another role get 403 Forbidden.
+func requireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			user := getCurrentUser(r)
+			if user == nil {
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return
+			}
+			if !hasRole(user, roles...) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// requireRoleOrSetup works like requireRole but lets everyone through while
+// there are no users yet, so that the first parent account can be created
+func requireRoleOrSetup(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		protected := requireRole(roles...)(next)
+		return func(w http.ResponseWriter, r *http.Request) {
+			count, err := countUsers(db)
+			if err != nil {
+				log.Printf("Error counting users: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if count == 0 {
+				next(w, r)
+				return
+			}
+			protected(w, r)
+		}
+	}
+}
+
+func countUsers(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+// checkOtherParents returns errLastParent unless there is an active parent
+// other than the given user
+func checkOtherParents(db *sql.DB, userID int) error {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM users WHERE role = ? AND archived_at IS NULL AND id <> ?
+	`, RoleParent, userID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errLastParent
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// certWatchInterval is how often the certificate files are checked
+	certWatchInterval = time.Minute
+	// certWarnDays is how close to expiry the watcher starts warning daily
+	certWarnDays = 14
+)
+
+// CertSource provides the server's TLS certificate. Run keeps it current
+// and GetCertificate is used for every TLS handshake, so a new certificate
+// is picked up without a restart.
+type CertSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	Run(ctx context.Context)
+}
+
+// certificates is the server's certificate source, shown on the status page
+var certificates CertSource
+
+// NewCertSource returns the certificate source selected in the config: ACME
+// or the certificate files, e.g. the ones certbot renews
+func NewCertSource(cfg Config) (CertSource, error) {
+	if cfg.ACME.Enabled {
+		return NewCertManager(cfg)
+	}
+	return NewCertWatcher(cfg.TLSCertFile, cfg.TLSKeyFile)
+}
+
+// CertWatcher serves the certificate in a pair of PEM files and reloads it
+// when the files change
+type CertWatcher struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // of the newer file when the certificate was loaded
+}
+
+// NewCertWatcher loads the certificate in certFile and keyFile
+func NewCertWatcher(certFile, keyFile string) (*CertWatcher, error) {
+	w := &CertWatcher{certFile: certFile, keyFile: keyFile}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (w *CertWatcher) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert, nil
+}
+
+// Run checks the files every minute and reloads the certificate when they
+// changed, until ctx is cancelled. A pair that doesn't load, e.g. because
+// certbot is halfway through writing it, keeps the old certificate until
+// the next check.
+func (w *CertWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+
+	lastWarning := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		modTime, err := w.filesModTime()
+		if err != nil {
+			log.Printf("Error checking certificate files: %v", err)
+			continue
+		}
+
+		w.mu.RLock()
+		changed := !modTime.Equal(w.modTime)
+		leaf := w.cert.Leaf
+		w.mu.RUnlock()
+
+		if changed {
+			if err := w.reload(); err != nil {
+				log.Printf("Error reloading certificate: %v", err)
+			}
+			continue
+		}
+		if time.Since(lastWarning) >= 24*time.Hour && daysUntilExpiry(leaf) < certWarnDays {
+			log.Printf("Certificate expires in %d days, on %s", daysUntilExpiry(leaf), leaf.NotAfter.Format(time.RFC1123))
+			lastWarning = time.Now()
+		}
+	}
+}
+
+// reload loads the certificate from the files
+func (w *CertWatcher) reload() error {
+	modTime, err := w.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	if err := parseLeaf(&cert); err != nil {
+		return err
+	}
+	logCertificate(cert.Leaf)
+
+	w.mu.Lock()
+	w.cert = &cert
+	w.modTime = modTime
+	w.mu.Unlock()
+	return nil
+}
+
+// filesModTime returns the modification time of the newer of the two files
+func (w *CertWatcher) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, file := range []string{w.certFile, w.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return newest, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// parseLeaf fills in cert.Leaf
+func parseLeaf(cert *tls.Certificate) error {
+	if cert.Leaf != nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %v", err)
+	}
+	cert.Leaf = leaf
+	return nil
+}
+
+// logCertificate logs which domains a certificate is for and when it expires
+func logCertificate(leaf *x509.Certificate) {
+	log.Printf("Using certificate for %s, valid until %s (%d days)",
+		strings.Join(leaf.DNSNames, ", "), leaf.NotAfter.Format(time.RFC1123), daysUntilExpiry(leaf))
+}
+
+// daysUntilExpiry returns the number of whole days the certificate is
+// still valid, negative once it has expired
+func daysUntilExpiry(leaf *x509.Certificate) int {
+	return int(math.Floor(time.Until(leaf.NotAfter).Hours() / 24))
+}
+
+// certificateStatus is the certificate part of the status endpoint
+type certificateStatus struct {
+	Domains         []string  `json:"domains"`
+	NotAfter        time.Time `json:"not_after"`
+	DaysUntilExpiry int       `json:"days_until_expiry"`
+}
+
+// statusHandler reports the server's health for monitoring, currently when
+// the certificate expires
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Certificate *certificateStatus `json:"certificate"`
+		Error       string             `json:"error,omitempty"`
+	}{}
+
+	var cert *tls.Certificate
+	var err error
+	if certificates != nil {
+		cert, err = certificates.GetCertificate(nil)
+	}
+	switch {
+	case err != nil:
+		status.Error = err.Error()
+	case cert != nil:
+		status.Certificate = &certificateStatus{
+			Domains:         cert.Leaf.DNSNames,
+			NotAfter:        cert.Leaf.NotAfter,
+			DaysUntilExpiry: daysUntilExpiry(cert.Leaf),
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
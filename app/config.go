@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the Docker image has no timezone database
+
+	"golang.org/x/crypto/acme"
+)
+
+// Config holds the server settings. They are read from an optional JSON
+// file and can be overridden with CHORES_* environment variables.
+type Config struct {
+	DatabasePath     string            `json:"database_path"`
+	ListenMode       string            `json:"listen_mode"`        // tls or http
+	ListenAddr       string            `json:"listen_addr"`        // :443 for tls and :8080 for http by default
+	HTTPRedirectAddr string            `json:"http_redirect_addr"` // tls mode: plain HTTP listener redirecting to HTTPS, e.g. :80
+	ACMEChallengeDir string            `json:"acme_challenge_dir"` // served to ACME HTTP-01 challenges on the redirect listener
+	TrustedProxies   []string          `json:"trusted_proxies"`    // addresses or networks whose X-Forwarded-For/Proto are believed
+	TLSCertFile      string            `json:"tls_cert_file"`
+	TLSKeyFile       string            `json:"tls_key_file"`
+	TemplateGlob     string            `json:"template_glob"`
+	EmailTemplateDir string            `json:"email_template_dir"`
+	StaticDir        string            `json:"static_dir"`
+	WeekStart        string            `json:"week_start"`    // first day of the week in reports, e.g. monday
+	Timezone         string            `json:"timezone"`      // IANA name of the household's timezone, e.g. Europe/Berlin, or Local for the server's (UTC in Docker)
+	Notifier         string            `json:"notifier"`      // smtp or log
+	NotifierFile     string            `json:"notifier_file"` // log notifier: file to append to instead of the log
+	SMTP             SMTPConfig        `json:"smtp"`
+	Schedules        map[string]string `json:"schedules"` // cron expressions by job name, overriding the defaults
+	ACME             ACMEConfig        `json:"acme"`
+	DuckDNS          DuckDNSConfig     `json:"duckdns"`
+	DynDNS           DynDNSConfig      `json:"dyndns"`
+
+	location       *time.Location
+	trustedProxies []*net.IPNet
+}
+
+// SMTPConfig holds the settings for sending email
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	TLS      string `json:"tls"` // starttls, tls or none
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// ACMEConfig holds the settings for getting certificates from Let's Encrypt
+// or another ACME server. The server proves it controls the domains with
+// DNS-01 challenges, so it needs no open port 80.
+type ACMEConfig struct {
+	Enabled            bool     `json:"enabled"` // instead of tls_cert_file and tls_key_file
+	Domains            []string `json:"domains"` // the DuckDNS domain by default
+	Email              string   `json:"email"`
+	DirectoryURL       string   `json:"directory_url"`
+	CAFile             string   `json:"ca_file"`   // root the ACME server's HTTPS certificate is checked against, e.g. pebble's
+	CacheDir           string   `json:"cache_dir"` // account key and certificates
+	DNSProvider        string   `json:"dns_provider"`
+	DNSCommand         string   `json:"dns_command"`         // exec provider
+	ChallTestSrvURL    string   `json:"challtestsrv_url"`    // challtestsrv provider
+	PropagationSeconds int      `json:"propagation_seconds"` // wait after creating the TXT record
+	RenewDays          int      `json:"renew_days"`          // renew when the certificate expires in fewer days
+}
+
+// DuckDNSConfig holds the DuckDNS account the server updates records with
+type DuckDNSConfig struct {
+	Domain string `json:"domain"` // e.g. myhouse.duckdns.org
+	Token  string `json:"token"`
+}
+
+// DynDNSConfig holds the settings for keeping DNS records pointed at the
+// server's public IP address, for households without a static one
+type DynDNSConfig struct {
+	Enabled         bool     `json:"enabled"`  // by default if there is a DuckDNS token
+	Provider        string   `json:"provider"` // duckdns or fake
+	Domains         []string `json:"domains"`  // the DuckDNS domain by default
+	IPURL           string   `json:"ip_url"`   // answers with the public IP address as plain text
+	IntervalSeconds int      `json:"interval_seconds"`
+}
+
+// defaultConfig returns the settings used when nothing else is configured.
+// The certificate paths follow the layout certbot uses in the Docker image.
+func defaultConfig() Config {
+	certDir := "/app/certbot/config/live/" + os.Getenv("DUCKDNS_SUBDOMAIN") + ".duckdns.org"
+	cfg := Config{
+		DatabasePath:     "./db/chores.db",
+		ListenMode:       ListenModeTLS,
+		TLSCertFile:      certDir + "/fullchain.pem",
+		TLSKeyFile:       certDir + "/privkey.pem",
+		TemplateGlob:     "app/templates/*.html",
+		EmailTemplateDir: "app/templates/email",
+		StaticDir:        "./app/static",
+		WeekStart:        "monday",
+		Timezone:         "Local",
+		Notifier:         NotifierLog,
+		SMTP: SMTPConfig{
+			Host: "smtp.gmail.com",
+			Port: 587,
+			TLS:  SMTPStartTLS,
+		},
+		ACME: ACMEConfig{
+			Email:              os.Getenv("EMAIL"),
+			DirectoryURL:       acme.LetsEncryptURL,
+			CacheDir:           "/app/certbot/acme",
+			DNSProvider:        DNSProviderDuckDNS,
+			ChallTestSrvURL:    "http://localhost:8055",
+			PropagationSeconds: 60,
+			RenewDays:          30,
+		},
+		DuckDNS: DuckDNSConfig{
+			Token: os.Getenv("DUCKDNS_TOKEN"),
+		},
+		DynDNS: DynDNSConfig{
+			Enabled:         os.Getenv("DUCKDNS_TOKEN") != "",
+			Provider:        DynDNSProviderDuckDNS,
+			IPURL:           "https://api.ipify.org",
+			IntervalSeconds: 300,
+		},
+	}
+	if subdomain := os.Getenv("DUCKDNS_SUBDOMAIN"); subdomain != "" {
+		cfg.DuckDNS.Domain = subdomain + ".duckdns.org"
+	}
+	return cfg
+}
+
+// LoadConfig reads the config file at path (if any) on top of the defaults,
+// applies environment overrides and validates the result
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return cfg, fmt.Errorf("error reading config file: %v", err)
+		}
+		defer f.Close()
+
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("error parsing config file %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":443"
+		if cfg.ListenMode == ListenModeHTTP {
+			cfg.ListenAddr = ":8080"
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	cfg.location, _ = time.LoadLocation(cfg.Timezone)
+	cfg.trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies)
+	return cfg, nil
+}
+
+// applyEnv overrides settings with the CHORES_* environment variables
+func (cfg *Config) applyEnv() error {
+	overrides := map[string]*string{
+		"CHORES_DB_PATH":         &cfg.DatabasePath,
+		"CHORES_LISTEN_MODE":     &cfg.ListenMode,
+		"CHORES_LISTEN_ADDR":     &cfg.ListenAddr,
+		"CHORES_HTTP_REDIRECT":   &cfg.HTTPRedirectAddr,
+		"CHORES_ACME_CHALLENGES": &cfg.ACMEChallengeDir,
+		"CHORES_TLS_CERT":        &cfg.TLSCertFile,
+		"CHORES_TLS_KEY":         &cfg.TLSKeyFile,
+		"CHORES_TEMPLATES":       &cfg.TemplateGlob,
+		"CHORES_EMAIL_TEMPLATES": &cfg.EmailTemplateDir,
+		"CHORES_WEEK_START":      &cfg.WeekStart,
+		"CHORES_TIMEZONE":        &cfg.Timezone,
+		"CHORES_STATIC_DIR":      &cfg.StaticDir,
+		"CHORES_NOTIFIER":        &cfg.Notifier,
+		"CHORES_NOTIFIER_FILE":   &cfg.NotifierFile,
+		"CHORES_SMTP_TLS":        &cfg.SMTP.TLS,
+		"CHORES_SMTP_HOST":       &cfg.SMTP.Host,
+		"CHORES_SMTP_USERNAME":   &cfg.SMTP.Username,
+		"CHORES_SMTP_PASSWORD":   &cfg.SMTP.Password,
+		"CHORES_SMTP_FROM":       &cfg.SMTP.From,
+		"CHORES_ACME_EMAIL":      &cfg.ACME.Email,
+		"CHORES_ACME_DIRECTORY":  &cfg.ACME.DirectoryURL,
+		"CHORES_ACME_CA_FILE":    &cfg.ACME.CAFile,
+		"CHORES_ACME_CACHE_DIR":  &cfg.ACME.CacheDir,
+		"CHORES_ACME_DNS":        &cfg.ACME.DNSProvider,
+		"CHORES_DUCKDNS_DOMAIN":  &cfg.DuckDNS.Domain,
+		"CHORES_DUCKDNS_TOKEN":   &cfg.DuckDNS.Token,
+		"CHORES_DYNDNS_PROVIDER": &cfg.DynDNS.Provider,
+		"CHORES_DYNDNS_IP_URL":   &cfg.DynDNS.IPURL,
+	}
+	for name, field := range overrides {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+
+	// docker-compose.yml has always passed the database as DATABASE_URL
+	if url, ok := os.LookupEnv("DATABASE_URL"); ok && os.Getenv("CHORES_DB_PATH") == "" {
+		cfg.DatabasePath = strings.TrimPrefix(url, "sqlite3:")
+	}
+
+	if value, ok := os.LookupEnv("CHORES_ACME"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid CHORES_ACME %q", value)
+		}
+		cfg.ACME.Enabled = enabled
+	}
+	if value, ok := os.LookupEnv("CHORES_ACME_DOMAINS"); ok {
+		cfg.ACME.Domains = strings.Fields(strings.ReplaceAll(value, ",", " "))
+	}
+	if value, ok := os.LookupEnv("CHORES_DYNDNS"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid CHORES_DYNDNS %q", value)
+		}
+		cfg.DynDNS.Enabled = enabled
+	}
+	if value, ok := os.LookupEnv("CHORES_DYNDNS_DOMAINS"); ok {
+		cfg.DynDNS.Domains = strings.Fields(strings.ReplaceAll(value, ",", " "))
+	}
+	if value, ok := os.LookupEnv("CHORES_TRUSTED_PROXIES"); ok {
+		cfg.TrustedProxies = strings.Fields(strings.ReplaceAll(value, ",", " "))
+	}
+
+	if value, ok := os.LookupEnv("CHORES_SMTP_PORT"); ok {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid CHORES_SMTP_PORT %q", value)
+		}
+		cfg.SMTP.Port = port
+	}
+	return nil
+}
+
+// Location returns the household's timezone
+func (cfg Config) Location() *time.Location {
+	if cfg.location == nil {
+		return time.Local
+	}
+	return cfg.location
+}
+
+// householdNow returns the current time in the household's timezone. Dates
+// such as "today" are always derived from it, so the day rolls over at the
+// family's midnight whatever timezone the server runs in.
+func householdNow() time.Time {
+	return time.Now().In(config.Location())
+}
+
+// householdToday returns today's date in the household's timezone, formatted
+// for the database
+func householdToday() string {
+	return householdNow().Format("2006-01-02")
+}
+
+// FirstWeekday returns the day weeks start on
+func (cfg Config) FirstWeekday() time.Weekday {
+	day, err := parseWeekday(cfg.WeekStart)
+	if err != nil {
+		return time.Monday
+	}
+	return day
+}
+
+// Validate checks the settings so that mistakes are reported at startup
+func (cfg Config) Validate() error {
+	if cfg.DatabasePath == "" {
+		return fmt.Errorf("database_path must be set")
+	}
+	if dir := filepath.Dir(cfg.DatabasePath); dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("database directory: %v", err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen_addr %q: %v", cfg.ListenAddr, err)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
+	switch cfg.ListenMode {
+	case ListenModeHTTP:
+		if cfg.ACME.Enabled || cfg.HTTPRedirectAddr != "" {
+			return fmt.Errorf("acme and http_redirect_addr need listen_mode tls")
+		}
+	case ListenModeTLS:
+		if err := cfg.validateTLS(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid listen_mode %q, use tls or http", cfg.ListenMode)
+	}
+	if cfg.DynDNS.Enabled {
+		if err := cfg.validateDynDNS(); err != nil {
+			return err
+		}
+	}
+	matches, err := filepath.Glob(cfg.TemplateGlob)
+	if err != nil || len(matches) == 0 {
+		return fmt.Errorf("template_glob %q matches no templates", cfg.TemplateGlob)
+	}
+	if info, err := os.Stat(cfg.EmailTemplateDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("email_template_dir %q is not a directory", cfg.EmailTemplateDir)
+	}
+	if info, err := os.Stat(cfg.StaticDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("static_dir %q is not a directory", cfg.StaticDir)
+	}
+	if cfg.Timezone == "" {
+		return fmt.Errorf("timezone must be set, use Local for the server's timezone")
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
+	}
+	if _, err := parseWeekday(cfg.WeekStart); err != nil {
+		return fmt.Errorf("invalid week_start: %v", err)
+	}
+	for name, expr := range cfg.Schedules {
+		if _, err := ParseCron(expr); err != nil {
+			return fmt.Errorf("schedule of %s: %v", name, err)
+		}
+	}
+	switch cfg.Notifier {
+	case NotifierLog:
+	case NotifierSMTP:
+		if cfg.SMTP.Host == "" || cfg.SMTP.From == "" {
+			return fmt.Errorf("the smtp notifier needs smtp host and from")
+		}
+		if cfg.SMTP.Port <= 0 || cfg.SMTP.Port > 65535 {
+			return fmt.Errorf("invalid smtp port %d", cfg.SMTP.Port)
+		}
+		switch cfg.SMTP.TLS {
+		case SMTPStartTLS, SMTPTLS, SMTPNone:
+		default:
+			return fmt.Errorf("invalid smtp tls mode %q, use starttls, tls or none", cfg.SMTP.TLS)
+		}
+	default:
+		return fmt.Errorf("invalid notifier %q, use smtp or log", cfg.Notifier)
+	}
+	return nil
+}
+
+// validateTLS checks the settings of the tls listen mode
+func (cfg Config) validateTLS() error {
+	if cfg.HTTPRedirectAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.HTTPRedirectAddr); err != nil {
+			return fmt.Errorf("invalid http_redirect_addr %q: %v", cfg.HTTPRedirectAddr, err)
+		}
+	}
+	if cfg.ACMEChallengeDir != "" {
+		if info, err := os.Stat(cfg.ACMEChallengeDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("acme_challenge_dir %q is not a directory", cfg.ACMEChallengeDir)
+		}
+	}
+	if cfg.ACME.Enabled {
+		return cfg.validateACME()
+	}
+	for _, file := range []string{cfg.TLSCertFile, cfg.TLSKeyFile} {
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("TLS certificate: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateACME checks the ACME settings
+func (cfg Config) validateACME() error {
+	if len(cfg.acmeDomains()) == 0 {
+		return fmt.Errorf("acme needs domains or a duckdns domain")
+	}
+	if u, err := url.Parse(cfg.ACME.DirectoryURL); err != nil || u.Scheme != "https" {
+		return fmt.Errorf("invalid acme directory_url %q", cfg.ACME.DirectoryURL)
+	}
+	if cfg.ACME.CAFile != "" {
+		if _, err := os.Stat(cfg.ACME.CAFile); err != nil {
+			return fmt.Errorf("acme ca_file: %v", err)
+		}
+	}
+	if cfg.ACME.CacheDir == "" {
+		return fmt.Errorf("acme cache_dir must be set")
+	}
+	if cfg.ACME.PropagationSeconds < 0 {
+		return fmt.Errorf("acme propagation_seconds can't be negative")
+	}
+	if cfg.ACME.RenewDays < 1 {
+		return fmt.Errorf("acme renew_days must be at least 1")
+	}
+	switch cfg.ACME.DNSProvider {
+	case DNSProviderDuckDNS:
+		if cfg.DuckDNS.Token == "" {
+			return fmt.Errorf("the duckdns dns provider needs a duckdns token")
+		}
+	case DNSProviderExec:
+		if cfg.ACME.DNSCommand == "" {
+			return fmt.Errorf("the exec dns provider needs a dns_command")
+		}
+	case DNSProviderChallTestSrv:
+		if _, err := url.Parse(cfg.ACME.ChallTestSrvURL); err != nil {
+			return fmt.Errorf("invalid acme challtestsrv_url: %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid acme dns_provider %q, use duckdns, exec or challtestsrv", cfg.ACME.DNSProvider)
+	}
+	return nil
+}
+
+// acmeDomains returns the domains to get a certificate for
+func (cfg Config) acmeDomains() []string {
+	if len(cfg.ACME.Domains) > 0 {
+		return cfg.ACME.Domains
+	}
+	if cfg.DuckDNS.Domain != "" {
+		return []string{cfg.DuckDNS.Domain}
+	}
+	return nil
+}
+
+// validateDynDNS checks the dynamic DNS settings
+func (cfg Config) validateDynDNS() error {
+	if len(cfg.dynDNSDomains()) == 0 {
+		return fmt.Errorf("dyndns needs domains or a duckdns domain")
+	}
+	if u, err := url.Parse(cfg.DynDNS.IPURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("invalid dyndns ip_url %q", cfg.DynDNS.IPURL)
+	}
+	if cfg.DynDNS.IntervalSeconds < 1 {
+		return fmt.Errorf("dyndns interval_seconds must be positive")
+	}
+	switch cfg.DynDNS.Provider {
+	case DynDNSProviderDuckDNS:
+		if cfg.DuckDNS.Token == "" {
+			return fmt.Errorf("the duckdns dyndns provider needs a duckdns token")
+		}
+	case DynDNSProviderFake:
+	default:
+		return fmt.Errorf("invalid dyndns provider %q, use duckdns or fake", cfg.DynDNS.Provider)
+	}
+	return nil
+}
+
+// dynDNSDomains returns the domains to keep pointed at the server
+func (cfg Config) dynDNSDomains() []string {
+	if len(cfg.DynDNS.Domains) > 0 {
+		return cfg.DynDNS.Domains
+	}
+	if cfg.DuckDNS.Domain != "" {
+		return []string{cfg.DuckDNS.Domain}
+	}
+	return nil
+}
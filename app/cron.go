@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression with the five usual fields:
+// minute, hour, day of month, month and day of week. Fields accept *,
+// numbers, ranges (1-5), lists (1,15) and steps (*/15, 0-30/10). Days of the
+// week are 0-6 starting on Sunday (7 is Sunday too) or names like mon.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets of the allowed values
+	domAny, dowAny                bool
+}
+
+// ParseCron parses a cron expression such as "59 23 * * sun"
+func ParseCron(expr string) (CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return CronSchedule{}, fmt.Errorf("invalid schedule %q: need 5 fields", expr)
+	}
+
+	var s CronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return s, fmt.Errorf("invalid minute in %q: %v", expr, err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return s, fmt.Errorf("invalid hour in %q: %v", expr, err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return s, fmt.Errorf("invalid day of month in %q: %v", expr, err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return s, fmt.Errorf("invalid month in %q: %v", expr, err)
+	}
+	dow := strings.ToLower(fields[4])
+	for i, name := range weekdayNames {
+		dow = strings.ReplaceAll(dow, name, strconv.Itoa(i))
+	}
+	if s.dow, err = parseCronField(dow, 0, 7); err != nil {
+		return s, fmt.Errorf("invalid day of week in %q: %v", expr, err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 // 7 is Sunday
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField parses one field into a bit set of the values it allows
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay reports whether the schedule runs on t's date. As in cron, a
+// restricted day of month and day of week match if either does.
+func (s CronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t the schedule runs, in t's location.
+// Times are wall clock times, so a job at 23:59 stays at 23:59 across DST
+// changes. It returns the zero time if the schedule never runs, e.g. on
+// February 31.
+func (s CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+
+	// Five years covers every valid schedule, including February 29
+	for limit := t.AddDate(5, 0, 0); next.Before(limit); {
+		switch {
+		case s.month&(1<<uint(next.Month())) == 0:
+			next = forward(next, time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, loc))
+		case !s.matchesDay(next):
+			next = forward(next, time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, loc))
+		case s.hour&(1<<uint(next.Hour())) == 0:
+			next = forward(next, time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, loc))
+		case s.minute&(1<<uint(next.Minute())) == 0:
+			next = forward(next, time.Date(next.Year(), next.Month(), next.Day(), next.Hour(), next.Minute()+1, 0, 0, loc))
+		case !next.After(t):
+			// The clock went back an hour; skip the repeated times
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// forward returns candidate, or t plus a minute if candidate is not after t.
+// time.Date can move a wall clock time that falls into a DST gap backwards.
+func forward(t, candidate time.Time) time.Time {
+	if candidate.After(t) {
+		return candidate
+	}
+	return t.Add(time.Minute)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * * someday",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+		tm, err := time.ParseInLocation("2006-01-02 15:04 MST", s, newYork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		expr string
+		from string
+		want string // empty if the schedule never runs
+	}{
+		{"0 0 * * *", "2026-10-17 10:00 EDT", "2026-10-18 00:00 EDT"},
+		{"0 0 * * *", "2026-10-17 00:00 EDT", "2026-10-18 00:00 EDT"}, // strictly after
+		{"*/15 * * * *", "2026-10-17 10:07 EDT", "2026-10-17 10:15 EDT"},
+		{"0-30/10 9 * * *", "2026-10-17 09:21 EDT", "2026-10-17 09:30 EDT"},
+		{"0-30/10 9 * * *", "2026-10-17 09:30 EDT", "2026-10-18 09:00 EDT"},
+		{"59 23 * * sun", "2026-10-17 12:00 EDT", "2026-10-18 23:59 EDT"},
+		{"0 0 * * 7", "2026-10-17 12:00 EDT", "2026-10-18 00:00 EDT"},
+		{"0 8 * * mon-fri", "2026-10-16 09:00 EDT", "2026-10-19 08:00 EDT"},
+		{"0 9 1,15 * *", "2026-10-15 09:00 EDT", "2026-11-01 09:00 EST"},
+		{"0 0 1 1 *", "2026-10-17 12:00 EDT", "2027-01-01 00:00 EST"},
+		// A restricted day of month and day of week match if either does
+		{"0 9 13 * fri", "2026-10-12 00:00 EDT", "2026-10-13 09:00 EDT"},
+		{"0 9 13 * fri", "2026-10-13 10:00 EDT", "2026-10-16 09:00 EDT"},
+		{"0 0 29 2 *", "2026-03-01 00:00 EST", "2028-02-29 00:00 EST"},
+		{"0 0 31 2 *", "2026-03-01 00:00 EST", ""},
+
+		// Jobs keep their wall clock time across DST changes
+		{"59 23 * * *", "2026-03-07 23:59 EST", "2026-03-08 23:59 EDT"},
+		{"59 23 * * *", "2026-10-31 23:59 EDT", "2026-11-01 23:59 EST"},
+		// Times in the hour skipped in spring don't exist on that day
+		{"30 2 * * *", "2026-03-08 00:00 EST", "2026-03-09 02:30 EDT"},
+		{"0 * * * *", "2026-03-08 01:30 EST", "2026-03-08 03:00 EDT"},
+		// Times in the hour repeated in autumn run once
+		{"30 1 * * *", "2026-11-01 00:00 EDT", "2026-11-01 01:30 EDT"},
+		{"30 1 * * *", "2026-11-01 01:30 EDT", "2026-11-02 01:30 EST"},
+		{"*/30 * * * *", "2026-11-01 01:45 EDT", "2026-11-01 02:00 EST"},
+	}
+	for _, tt := range tests {
+		s, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+		}
+		got := s.Next(at(tt.from))
+		if want := at(tt.want); !got.Equal(want) {
+			t.Errorf("%q after %s = %v, want %v", tt.expr, tt.from, got, want)
+		}
+	}
+}
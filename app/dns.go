@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DNS providers for ACME DNS-01 challenges
+const (
+	DNSProviderDuckDNS      = "duckdns"      // TXT records via the DuckDNS API
+	DNSProviderExec         = "exec"         // a script of your own
+	DNSProviderChallTestSrv = "challtestsrv" // pebble's test DNS server
+)
+
+// DNSProvider creates and removes the TXT records of DNS-01 challenges.
+// fqdn is the record name, e.g. _acme-challenge.myhouse.duckdns.org.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// NewDNSProvider returns the DNS provider selected in the config
+func NewDNSProvider(cfg Config) (DNSProvider, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch cfg.ACME.DNSProvider {
+	case DNSProviderDuckDNS:
+		return &duckDNSProvider{token: cfg.DuckDNS.Token, client: client}, nil
+	case DNSProviderExec:
+		return &execDNSProvider{command: cfg.ACME.DNSCommand}, nil
+	case DNSProviderChallTestSrv:
+		return &challTestSrvProvider{url: strings.TrimSuffix(cfg.ACME.ChallTestSrvURL, "/"), client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown DNS provider %q", cfg.ACME.DNSProvider)
+}
+
+// duckDNSProvider sets the TXT record DuckDNS keeps for each domain. There
+// is only one per domain, so it can answer one challenge at a time.
+type duckDNSProvider struct {
+	token  string
+	client *http.Client
+}
+
+func (p *duckDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return duckDNSUpdate(ctx, p.client, url.Values{
+		"domains": {duckDNSSubdomain(fqdn)},
+		"token":   {p.token},
+		"txt":     {value},
+	})
+}
+
+func (p *duckDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return duckDNSUpdate(ctx, p.client, url.Values{
+		"domains": {duckDNSSubdomain(fqdn)},
+		"token":   {p.token},
+		"txt":     {value},
+		"clear":   {"true"},
+	})
+}
+
+// duckDNSSubdomain returns the DuckDNS subdomain a record name belongs to,
+// e.g. myhouse for _acme-challenge.myhouse.duckdns.org
+func duckDNSSubdomain(fqdn string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(fqdn, "."), ".duckdns.org")
+	parts := strings.Split(name, ".")
+	return parts[len(parts)-1]
+}
+
+// duckDNSUpdate calls the DuckDNS update API, which answers OK or KO
+func duckDNSUpdate(ctx context.Context, client *http.Client, params url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.duckdns.org/update?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("duckdns: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("duckdns: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "OK") {
+		return fmt.Errorf("duckdns: update failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// execDNSProvider runs a command to manage the records, as
+// "command present|cleanup <fqdn> <value>". Use it for DNS hosts without
+// a built-in provider.
+type execDNSProvider struct {
+	command string
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", p.command, action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// challTestSrvProvider sets records through the management API of
+// challtestsrv, the DNS server pebble checks challenges against in tests
+type challTestSrvProvider struct {
+	url    string
+	client *http.Client
+}
+
+func (p *challTestSrvProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.post(ctx, "/set-txt", map[string]string{"host": dnsName(fqdn), "value": value})
+}
+
+func (p *challTestSrvProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.post(ctx, "/clear-txt", map[string]string{"host": dnsName(fqdn)})
+}
+
+func (p *challTestSrvProvider) post(ctx context.Context, path string, body map[string]string) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("challtestsrv: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("challtestsrv: %s %s", path, resp.Status)
+	}
+	return nil
+}
+
+// dnsName returns the fully qualified form of a name, with the final dot
+func dnsName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
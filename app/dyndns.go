@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dynamic DNS providers
+const (
+	DynDNSProviderDuckDNS = "duckdns" // the DuckDNS update API
+	DynDNSProviderFake    = "fake"    // records kept in memory, for tests and development
+)
+
+const (
+	// dynDNSTimeout limits how long one check of all domains may take
+	dynDNSTimeout = time.Minute
+	// dynDNSRefreshInterval is how often records are set even if the
+	// address didn't change, in case they were changed elsewhere
+	dynDNSRefreshInterval = 24 * time.Hour
+	// dynDNSRetryDelay is the wait after the first failure. It doubles with
+	// every further failure, up to dynDNSMaxBackoff.
+	dynDNSRetryDelay = 30 * time.Second
+	dynDNSMaxBackoff = time.Hour
+)
+
+// DynDNSProvider points a domain's address record at an IP address
+type DynDNSProvider interface {
+	Update(ctx context.Context, domain string, ip net.IP) error
+}
+
+// DynDNSStatus is the state of one domain's record, kept in the
+// dyndns_status table for the server page
+type DynDNSStatus struct {
+	Domain    string
+	Provider  string
+	IP        string    // the address the record was last set to
+	CheckedAt time.Time // last check, successful or not
+	UpdatedAt time.Time // zero if never set
+	LastError string    // of the last check, empty if it succeeded
+	Failures  int       // failed checks in a row
+}
+
+// NewDynDNSProvider returns the dynamic DNS provider selected in the config
+func NewDynDNSProvider(cfg Config) (DynDNSProvider, error) {
+	switch cfg.DynDNS.Provider {
+	case DynDNSProviderDuckDNS:
+		return &duckDNSUpdater{token: cfg.DuckDNS.Token, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case DynDNSProviderFake:
+		return &FakeDynDNSProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown dynamic DNS provider %q", cfg.DynDNS.Provider)
+}
+
+// duckDNSUpdater sets the address of DuckDNS domains
+type duckDNSUpdater struct {
+	token  string
+	client *http.Client
+}
+
+func (p *duckDNSUpdater) Update(ctx context.Context, domain string, ip net.IP) error {
+	params := url.Values{
+		"domains": {duckDNSSubdomain(domain)},
+		"token":   {p.token},
+	}
+	if ip.To4() != nil {
+		params.Set("ip", ip.String())
+	} else {
+		params.Set("ipv6", ip.String())
+	}
+	return duckDNSUpdate(ctx, p.client, params)
+}
+
+// FakeDynDNSProvider keeps the records in memory instead of changing DNS.
+// Set Err to make updates fail.
+type FakeDynDNSProvider struct {
+	mu      sync.Mutex
+	Records map[string]string // addresses by domain
+	Err     error
+}
+
+func (p *FakeDynDNSProvider) Update(ctx context.Context, domain string, ip net.IP) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Err != nil {
+		return p.Err
+	}
+	if p.Records == nil {
+		p.Records = make(map[string]string)
+	}
+	p.Records[domain] = ip.String()
+	return nil
+}
+
+// DynDNSUpdater keeps the records of the configured domains pointed at the
+// server's public IP address
+type DynDNSUpdater struct {
+	db       *sql.DB
+	provider DynDNSProvider
+	name     string // of the provider, for the status
+	domains  []string
+	interval time.Duration
+	publicIP func(ctx context.Context) (net.IP, error)
+}
+
+// NewDynDNSUpdater returns an updater for the dynamic DNS settings in cfg
+func NewDynDNSUpdater(db *sql.DB, cfg Config) (*DynDNSUpdater, error) {
+	provider, err := NewDynDNSProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	return &DynDNSUpdater{
+		db:       db,
+		provider: provider,
+		name:     cfg.DynDNS.Provider,
+		domains:  cfg.dynDNSDomains(),
+		interval: time.Duration(cfg.DynDNS.IntervalSeconds) * time.Second,
+		publicIP: func(ctx context.Context) (net.IP, error) {
+			return lookupPublicIP(ctx, client, cfg.DynDNS.IPURL)
+		},
+	}, nil
+}
+
+// Run checks the public IP address every interval and updates the records
+// when it changed, until ctx is cancelled. After a failure it retries
+// sooner, backing off with every further failure.
+func (u *DynDNSUpdater) Run(ctx context.Context) {
+	for {
+		wait := u.interval
+		if failures := u.check(ctx); failures > 0 {
+			wait = dynDNSBackoff(failures)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check updates every domain whose record is out of date and returns the
+// most failures in a row of any domain
+func (u *DynDNSUpdater) check(ctx context.Context) int {
+	ctx, cancel := context.WithTimeout(ctx, dynDNSTimeout)
+	defer cancel()
+
+	ip, ipErr := u.publicIP(ctx)
+	if ipErr != nil {
+		log.Printf("Error looking up the public IP address: %v", ipErr)
+	}
+
+	maxFailures := 0
+	for _, domain := range u.domains {
+		if ctx.Err() == context.Canceled {
+			break // shutting down
+		}
+		status, err := GetDynDNSStatus(u.db, domain)
+		if err != nil {
+			log.Printf("Error fetching dynamic DNS status of %s: %v", domain, err)
+			continue
+		}
+		status.CheckedAt = time.Now()
+
+		// A record set through another provider may not exist with this one
+		err = ipErr
+		if err == nil && (status.IP != ip.String() || status.Provider != u.name || status.LastError != "" ||
+			time.Since(status.UpdatedAt) >= dynDNSRefreshInterval) {
+			err = u.provider.Update(ctx, domain, ip)
+			if err == nil {
+				if status.IP != ip.String() {
+					log.Printf("Pointed %s at %s", domain, ip)
+				}
+				status.IP = ip.String()
+				status.UpdatedAt = status.CheckedAt
+			} else {
+				log.Printf("Error updating %s: %v", domain, err)
+			}
+		}
+		status.Provider = u.name
+
+		if err != nil {
+			status.LastError = err.Error()
+			status.Failures++
+		} else {
+			status.LastError = ""
+			status.Failures = 0
+		}
+		if err := SaveDynDNSStatus(u.db, status); err != nil {
+			log.Printf("Error saving dynamic DNS status of %s: %v", domain, err)
+		}
+		if status.Failures > maxFailures {
+			maxFailures = status.Failures
+		}
+	}
+	return maxFailures
+}
+
+// dynDNSBackoff returns how long to wait after the given number of
+// failures in a row
+func dynDNSBackoff(failures int) time.Duration {
+	wait := dynDNSRetryDelay
+	for i := 1; i < failures && wait < dynDNSMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > dynDNSMaxBackoff {
+		wait = dynDNSMaxBackoff
+	}
+	return wait
+}
+
+// lookupPublicIP asks a service such as ipify which address our requests
+// come from. It must answer with just the address.
+func lookupPublicIP(ctx context.Context, client *http.Client, serviceURL string) (net.IP, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", serviceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", serviceURL, resp.Status)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s answered %q, not an IP address", serviceURL, strings.TrimSpace(string(body)))
+	}
+	return ip, nil
+}
+
+// GetDynDNSStatus returns the status of a domain, without times if it was
+// never checked
+func GetDynDNSStatus(db *sql.DB, domain string) (DynDNSStatus, error) {
+	statuses, err := getDynDNSStatuses(db, "WHERE domain = ?", domain)
+	if err != nil || len(statuses) == 0 {
+		return DynDNSStatus{Domain: domain}, err
+	}
+	return statuses[0], nil
+}
+
+// GetDynDNSStatuses returns the status of every domain that was checked
+func GetDynDNSStatuses(db *sql.DB) ([]DynDNSStatus, error) {
+	return getDynDNSStatuses(db, "ORDER BY domain")
+}
+
+func getDynDNSStatuses(db *sql.DB, where string, args ...interface{}) ([]DynDNSStatus, error) {
+	rows, err := db.Query(`
+		SELECT domain, provider, ip, checked_at, updated_at, last_error, failures FROM dyndns_status
+	`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []DynDNSStatus
+	for rows.Next() {
+		var s DynDNSStatus
+		var ip, lastError sql.NullString
+		var checkedAt int64
+		var updatedAt sql.NullInt64
+		if err := rows.Scan(&s.Domain, &s.Provider, &ip, &checkedAt, &updatedAt, &lastError, &s.Failures); err != nil {
+			return nil, err
+		}
+		s.IP = ip.String
+		s.LastError = lastError.String
+		s.CheckedAt = time.Unix(checkedAt, 0).In(config.Location())
+		if updatedAt.Valid {
+			s.UpdatedAt = time.Unix(updatedAt.Int64, 0).In(config.Location())
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+// SaveDynDNSStatus stores the status of a domain
+func SaveDynDNSStatus(db *sql.DB, s DynDNSStatus) error {
+	var ip, lastError sql.NullString
+	var updatedAt sql.NullInt64
+	if s.IP != "" {
+		ip = sql.NullString{String: s.IP, Valid: true}
+	}
+	if s.LastError != "" {
+		lastError = sql.NullString{String: s.LastError, Valid: true}
+	}
+	if !s.UpdatedAt.IsZero() {
+		updatedAt = sql.NullInt64{Int64: s.UpdatedAt.Unix(), Valid: true}
+	}
+	_, err := db.Exec(`
+		INSERT INTO dyndns_status (domain, provider, ip, checked_at, updated_at, last_error, failures)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (domain) DO UPDATE SET
+			provider = excluded.provider,
+			ip = excluded.ip,
+			checked_at = excluded.checked_at,
+			updated_at = excluded.updated_at,
+			last_error = excluded.last_error,
+			failures = excluded.failures
+	`, s.Domain, s.Provider, ip, s.CheckedAt.Unix(), updatedAt, lastError, s.Failures)
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestDynDNSUpdater returns an updater for two domains that uses a fake
+// provider and a database of its own. The public IP address it finds is
+// whatever *ip points at when check runs.
+func newTestDynDNSUpdater(t *testing.T) (*DynDNSUpdater, *FakeDynDNSProvider, *net.IP) {
+	t.Helper()
+	db := newTestDB(t)
+
+	provider := &FakeDynDNSProvider{}
+	ip := net.ParseIP("203.0.113.1")
+	updater := &DynDNSUpdater{
+		db:       db,
+		provider: provider,
+		name:     DynDNSProviderFake,
+		domains:  []string{"a.example.com", "b.example.com"},
+		interval: time.Minute,
+		publicIP: func(ctx context.Context) (net.IP, error) {
+			if ip == nil {
+				return nil, errors.New("lookup failed")
+			}
+			return ip, nil
+		},
+	}
+	return updater, provider, &ip
+}
+
+func mustDynDNSStatus(t *testing.T, u *DynDNSUpdater, domain string) DynDNSStatus {
+	t.Helper()
+	status, err := GetDynDNSStatus(u.db, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestDynDNSCheckUpdatesChangedAddress(t *testing.T) {
+	u, provider, ip := newTestDynDNSUpdater(t)
+	ctx := context.Background()
+
+	if failures := u.check(ctx); failures != 0 {
+		t.Fatalf("first check: %d failures, want 0", failures)
+	}
+	for _, domain := range u.domains {
+		if got := provider.Records[domain]; got != "203.0.113.1" {
+			t.Errorf("%s points at %q after first check, want 203.0.113.1", domain, got)
+		}
+		status := mustDynDNSStatus(t, u, domain)
+		if status.IP != "203.0.113.1" || status.Provider != DynDNSProviderFake || status.UpdatedAt.IsZero() {
+			t.Errorf("%s status after first check: %+v", domain, status)
+		}
+	}
+
+	// Unchanged address: the records are left alone
+	delete(provider.Records, "a.example.com")
+	u.check(ctx)
+	if _, ok := provider.Records["a.example.com"]; ok {
+		t.Error("record updated although the address didn't change")
+	}
+
+	// Changed address: every record is updated
+	*ip = net.ParseIP("203.0.113.2")
+	u.check(ctx)
+	for _, domain := range u.domains {
+		if got := provider.Records[domain]; got != "203.0.113.2" {
+			t.Errorf("%s points at %q after address change, want 203.0.113.2", domain, got)
+		}
+	}
+}
+
+func TestDynDNSCheckUpdatesAfterProviderChange(t *testing.T) {
+	u, provider, _ := newTestDynDNSUpdater(t)
+
+	// Set recently with the same address, but through another provider
+	for _, domain := range u.domains {
+		err := SaveDynDNSStatus(u.db, DynDNSStatus{
+			Domain:    domain,
+			Provider:  DynDNSProviderDuckDNS,
+			IP:        "203.0.113.1",
+			CheckedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u.check(context.Background())
+	for _, domain := range u.domains {
+		if got := provider.Records[domain]; got != "203.0.113.1" {
+			t.Errorf("%s not updated after provider change, points at %q", domain, got)
+		}
+		if status := mustDynDNSStatus(t, u, domain); status.Provider != DynDNSProviderFake {
+			t.Errorf("%s status has provider %q, want %q", domain, status.Provider, DynDNSProviderFake)
+		}
+	}
+}
+
+func TestDynDNSCheckCountsFailures(t *testing.T) {
+	u, provider, ip := newTestDynDNSUpdater(t)
+	ctx := context.Background()
+
+	provider.Err = errors.New("provider down")
+	for want := 1; want <= 3; want++ {
+		if failures := u.check(ctx); failures != want {
+			t.Fatalf("check %d with failing provider: %d failures, want %d", want, failures, want)
+		}
+	}
+	status := mustDynDNSStatus(t, u, "a.example.com")
+	if status.LastError != "provider down" || status.Failures != 3 || !status.UpdatedAt.IsZero() {
+		t.Errorf("status after failed updates: %+v", status)
+	}
+
+	// A failed address lookup counts too
+	provider.Err = nil
+	*ip = nil
+	if failures := u.check(ctx); failures != 4 {
+		t.Errorf("check with failing lookup: %d failures, want 4", failures)
+	}
+
+	// A success resets the count
+	*ip = net.ParseIP("203.0.113.1")
+	if failures := u.check(ctx); failures != 0 {
+		t.Errorf("check after recovery: %d failures, want 0", failures)
+	}
+	status = mustDynDNSStatus(t, u, "a.example.com")
+	if status.LastError != "" || status.Failures != 0 || status.IP != "203.0.113.1" {
+		t.Errorf("status after recovery: %+v", status)
+	}
+}
+
+func TestDynDNSBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := dynDNSBackoff(tt.failures); got != tt.want {
+			t.Errorf("dynDNSBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
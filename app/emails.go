@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	texttemplate "text/template"
+)
+
+// Email templates come in pairs in the email template directory: NAME.html
+// renders the HTML part and NAME.txt the plain text part of the email.
+var (
+	emailHTML *template.Template
+	emailText *texttemplate.Template
+)
+
+// SummaryChore is a completed chore listed in a summary email
+type SummaryChore struct {
+	Name   string
+	Points int
+}
+
+// ChildSummary is one child's part of a daily summary email
+type ChildSummary struct {
+	Username string
+	Chores   []SummaryChore
+	Points   int
+}
+
+// SummaryEmail is the data the summary email templates are rendered with.
+// Daily summaries fill Children, weekly summaries Week. Both only hold the
+// recipient's own chores unless the recipient is a parent.
+type SummaryEmail struct {
+	Recipient User
+	IsParent  bool
+	Children  []ChildSummary
+	Week      *WeeklyReport
+}
+
+// loadEmailTemplates parses the email templates in dir
+func loadEmailTemplates(dir string) error {
+	var err error
+	emailHTML, err = template.ParseGlob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return fmt.Errorf("error loading HTML email templates: %v", err)
+	}
+	emailText, err = texttemplate.ParseGlob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return fmt.Errorf("error loading text email templates: %v", err)
+	}
+	return nil
+}
+
+// renderEmail renders the text and HTML parts of the named email into msg
+func renderEmail(msg *Message, name string, data interface{}) error {
+	var text, html bytes.Buffer
+	if err := emailText.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return err
+	}
+	if err := emailHTML.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return err
+	}
+	msg.Body = text.String()
+	msg.HTML = html.String()
+	return nil
+}
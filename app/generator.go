@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// maxBackfillDays limits how far back missed days are filled in
+const maxBackfillDays = 31
+
+// backfillDailyChores assigns due chores for every day from the last day
+// that has assignments up to and including today. It runs on startup and
+// as the scheduler's daily_chores job shortly after midnight. Assigning is idempotent,
+// so the last day is revisited in case chores were added since. Chores
+// assigned by hand for future days don't count, or generation would stop
+// until then.
+func backfillDailyChores(db *sql.DB, today time.Time) error {
+	// Before tomorrow rather than up to today, as dates may have a time part.
+	// Not MAX(date), which would come back as a string rather than a time.
+	var last time.Time
+	tomorrow := today.AddDate(0, 0, 1).Format("2006-01-02")
+	err := db.QueryRow("SELECT date FROM daily_chores WHERE date < ? ORDER BY date DESC LIMIT 1", tomorrow).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	start := today
+	if err == nil {
+		start = time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, today.Location())
+	}
+	if earliest := today.AddDate(0, 0, -maxBackfillDays); start.Before(earliest) {
+		log.Printf("Daily chores missing since %s, backfilling only the last %d days", start.Format("2006-01-02"), maxBackfillDays)
+		start = earliest
+	}
+
+	for day := start; daysBetween(day, today) >= 0; day = day.AddDate(0, 0, 1) {
+		if err := AssignDueChores(db, day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"chore-tracker/app/migrations"
+)
+
+// newTestDB returns a migrated database of the test's own and points the db
+// and config globals at it and the default config until the test ends
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "chores.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrations.Run(testDB); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDB, oldConfig := db, config
+	db, config = testDB, defaultConfig()
+	t.Cleanup(func() {
+		db, config = oldDB, oldConfig
+		testDB.Close()
+	})
+	return testDB
+}
+
+// addTestUser creates a user with the given role and returns their ID
+func addTestUser(t *testing.T, db *sql.DB, username, role string) int {
+	t.Helper()
+	result, err := db.Exec(`
+		INSERT INTO users (username, hash, email, role) VALUES (?, '', ?, ?)
+	`, username, username+"@example.com", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+func mustBalance(t *testing.T, db *sql.DB, userID int) int {
+	t.Helper()
+	balance, err := GetBalance(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sources of points transactions
+const (
+	SourceOpeningBalance = "opening_balance"
+	SourceChore          = "chore"
+	SourceWeeklyReset    = "weekly_reset"
+	SourceReward         = "reward"
+	SourceRewardRefund   = "reward_refund"
+	SourceAllowance      = "allowance"
+)
+
+// userBalanceSQL selects a user's points balance from the ledger, for use
+// in queries on the users table
+const userBalanceSQL = "(SELECT IFNULL(SUM(pt.amount), 0) FROM points_transactions pt WHERE pt.user_id = users.id)"
+
+// PointsTransaction is an entry in the append-only points ledger. A user's
+// balance is the sum of the amounts of their transactions.
+type PointsTransaction struct {
+	ID           int
+	UserID       int
+	Amount       int
+	Source       string
+	ChoreID      sql.NullInt64
+	DailyChoreID sql.NullInt64
+	ActorID      sql.NullInt64
+	Note         string
+	CreatedAt    time.Time
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// recordPoints appends a transaction to the points ledger
+func recordPoints(db execer, t PointsTransaction) error {
+	_, err := db.Exec(`
+		INSERT INTO points_transactions (user_id, amount, source, chore_id, daily_chore_id, actor_id, note, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, t.UserID, t.Amount, t.Source, t.ChoreID, t.DailyChoreID, t.ActorID, t.Note, time.Now().Unix())
+	return err
+}
+
+// nullID wraps an ID for the nullable ledger columns
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: true}
+}
+
+// reverseChorePoints takes back the points credited for a daily chore. It
+// reverses what the ledger holds rather than the chore's current points,
+// which may have been edited since.
+func reverseChorePoints(tx *sql.Tx, dailyChoreID, actorID int, note string) error {
+	_, err := tx.Exec(`
+		INSERT INTO points_transactions (user_id, amount, source, chore_id, daily_chore_id, actor_id, note, created_at)
+		SELECT user_id, -SUM(amount), ?, MAX(chore_id), daily_chore_id, ?, ?, ?
+		FROM points_transactions
+		WHERE daily_chore_id = ? AND source = ?
+		GROUP BY user_id, daily_chore_id
+		HAVING SUM(amount) <> 0
+	`, SourceChore, actorID, note, time.Now().Unix(), dailyChoreID, SourceChore)
+	return err
+}
+
+// GetBalance returns the user's current points balance
+func GetBalance(db querier, userID int) (int, error) {
+	var balance int
+	err := db.QueryRow("SELECT IFNULL(SUM(amount), 0) FROM points_transactions WHERE user_id = ?", userID).Scan(&balance)
+	return balance, err
+}
+
+// GetPointsHistory returns the user's most recent ledger entries, newest first
+func GetPointsHistory(db *sql.DB, userID int, limit int) ([]PointsTransaction, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, amount, source, chore_id, daily_chore_id, actor_id, IFNULL(note, ''), created_at
+		FROM points_transactions
+		WHERE user_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []PointsTransaction{}
+	for rows.Next() {
+		var t PointsTransaction
+		var createdAt int64
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Amount, &t.Source, &t.ChoreID, &t.DailyChoreID, &t.ActorID, &t.Note, &createdAt); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = time.Unix(createdAt, 0).In(config.Location())
+		history = append(history, t)
+	}
+	return history, rows.Err()
+}
+
+// pointsEarnedBetween returns the chore points credited to the user for
+// chores due between the two dates (inclusive, formatted as 2006-01-02)
+func pointsEarnedBetween(db querier, userID int, from, to string) (int, error) {
+	var points int
+	err := db.QueryRow(`
+		SELECT IFNULL(SUM(pt.amount), 0)
+		FROM points_transactions pt
+		JOIN daily_chores dc ON pt.daily_chore_id = dc.id
+		WHERE pt.user_id = ? AND pt.source = ? AND dc.date BETWEEN ? AND ?
+	`, userID, SourceChore, from, to).Scan(&points)
+	return points, err
+}
+
+// ResetWeeklyPoints brings the balances of parents back to zero by
+// recording an offsetting transaction per user, keeping the history intact.
+// A parent's points are only a score for the week. Children's balances
+// carry over, as they are spent: the weekly allowance has already cashed in
+// the points it paid for, and the rest is saved for rewards, so resetting
+// them would take away savings and let refunds land in a later week.
+func ResetWeeklyPoints(db execer) error {
+	_, err := db.Exec(`
+		INSERT INTO points_transactions (user_id, amount, source, created_at)
+		SELECT user_id, -SUM(amount), ?, ?
+		FROM points_transactions
+		WHERE user_id IN (SELECT id FROM users WHERE role <> ?)
+		GROUP BY user_id
+		HAVING SUM(amount) <> 0
+	`, SourceWeeklyReset, time.Now().Unix(), RoleChild)
+	return err
+}
+
+// getPointsHistoryHandler returns the ledger entries of the current user as
+// JSON. Parents can look at another user's history with ?user_id=.
+func getPointsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Error(w, "User not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	userID := user.ID
+	if idStr := r.URL.Query().Get("user_id"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if id != user.ID && user.Role != RoleParent {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		userID = id
+	}
+
+	history, err := GetPointsHistory(db, userID, 100)
+	if err != nil {
+		log.Printf("Error fetching points history: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		log.Printf("Error encoding points history to JSON: %v", err)
+	}
+}
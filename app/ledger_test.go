@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestResetWeeklyPointsKeepsChildrenSavings(t *testing.T) {
+	db := newTestDB(t)
+	parent := addTestUser(t, db, "parent", RoleParent)
+	child := addTestUser(t, db, "child", RoleChild)
+	for _, tr := range []PointsTransaction{
+		{UserID: parent, Amount: 12, Source: SourceChore},
+		{UserID: child, Amount: 20, Source: SourceChore},
+		{UserID: child, Amount: -5, Source: SourceReward},
+	} {
+		if err := recordPoints(db, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for run := 1; run <= 2; run++ {
+		if err := ResetWeeklyPoints(db); err != nil {
+			t.Fatal(err)
+		}
+		if got := mustBalance(t, db, parent); got != 0 {
+			t.Errorf("reset %d: parent balance %d, want 0", run, got)
+		}
+		if got := mustBalance(t, db, child); got != 15 {
+			t.Errorf("reset %d: child balance %d, want 15", run, got)
+		}
+	}
+
+	var resets int
+	if err := db.QueryRow("SELECT COUNT(*) FROM points_transactions WHERE source = ?", SourceWeeklyReset).Scan(&resets); err != nil {
+		t.Fatal(err)
+	}
+	if resets != 1 {
+		t.Errorf("%d reset transactions, want 1 as the second reset has nothing to offset", resets)
+	}
+}
+
+func TestReverseChorePoints(t *testing.T) {
+	db := newTestDB(t)
+	parent := addTestUser(t, db, "parent", RoleParent)
+	child := addTestUser(t, db, "child", RoleChild)
+	dailyChoreID := addApprovedChore(t, db, child, parent, "2026-10-13", 5)
+	otherID := addApprovedChore(t, db, child, parent, "2026-10-14", 3)
+
+	reverse := func() {
+		t.Helper()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := reverseChorePoints(tx, dailyChoreID, parent, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The chore's points changed since it was approved
+	if _, err := db.Exec("UPDATE chores SET points = 9 WHERE id = (SELECT chore_id FROM daily_chores WHERE id = ?)", dailyChoreID); err != nil {
+		t.Fatal(err)
+	}
+	reverse()
+	if got := mustBalance(t, db, child); got != 3 {
+		t.Errorf("balance %d after reversing, want the other chore's 3", got)
+	}
+
+	// Nothing is left to reverse
+	reverse()
+	var reversals int
+	err := db.QueryRow("SELECT COUNT(*) FROM points_transactions WHERE daily_chore_id = ? AND amount < 0", dailyChoreID).Scan(&reversals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reversals != 1 {
+		t.Errorf("%d reversals after reversing twice, want 1", reversals)
+	}
+
+	// Approved again at the new points and reversed
+	if _, err := db.Exec("UPDATE daily_chores SET status = ? WHERE id = ?", StatusPending, dailyChoreID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApproveChore(db, dailyChoreID, parent); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustBalance(t, db, child); got != 12 {
+		t.Errorf("balance %d after approving again, want 12", got)
+	}
+	reverse()
+	if got := mustBalance(t, db, child); got != 3 {
+		t.Errorf("balance %d after reversing again, want 3", got)
+	}
+
+	var other int
+	err = db.QueryRow("SELECT SUM(amount) FROM points_transactions WHERE daily_chore_id = ?", otherID).Scan(&other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other != 3 {
+		t.Errorf("other chore holds %d points, want 3", other)
+	}
+}
+
+func TestUndoAndRejectTakeBackCreditedPoints(t *testing.T) {
+	tests := []struct {
+		name string
+		undo func(db *sql.DB, parent, child *User, dailyChoreID int) error
+	}{
+		{"undo", func(db *sql.DB, parent, child *User, dailyChoreID int) error {
+			dc, err := GetDailyChore(db, dailyChoreID)
+			if err != nil {
+				return err
+			}
+			return MarkChoreCompleted(db, parent, child, dc.ChoreID, dc.Date, false)
+		}},
+		{"reject", func(db *sql.DB, parent, child *User, dailyChoreID int) error {
+			return RejectChore(db, dailyChoreID, parent.ID, "not done")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			parentID := addTestUser(t, db, "parent", RoleParent)
+			childID := addTestUser(t, db, "child", RoleChild)
+			dailyChoreID := addApprovedChore(t, db, childID, parentID, "2026-10-13", 5)
+			if _, err := db.Exec("UPDATE chores SET points = 50"); err != nil {
+				t.Fatal(err)
+			}
+			parent, err := GetUserByID(db, parentID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			child, err := GetUserByID(db, childID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.undo(db, parent, child, dailyChoreID); err != nil {
+				t.Fatal(err)
+			}
+			if got := mustBalance(t, db, childID); got != 0 {
+				t.Errorf("balance %d, want 0", got)
+			}
+		})
+	}
+}
@@ -1,113 +1,178 @@
 package main
 
 import (
+	"context"
         "database/sql"
 	"encoding/json"
+        "flag"
         "fmt"
         "html/template"
         "log"
-	"math/rand"
         "net/http"
-        "net/smtp"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
         "time"
         "strconv"
 
         _ "github.com/mattn/go-sqlite3"
+
+        "chore-tracker/app/migrations"
         //"golang.org/x/crypto/bcrypt"
 )
 
 // Database models - see models.go
 
-var templates = template.Must(template.ParseGlob("app/templates/*.html"))
+var templates *template.Template
 var db *sql.DB
+var config Config
 
-// Simple session management (for demonstration purposes only)
-var sessions = make(map[string]int) // Session ID -> User ID
+func main() {
+        configPath := flag.String("config", os.Getenv("CHORES_CONFIG"), "path to a JSON config file")
+        flag.Parse()
 
-// generateSessionID generates a simple random session ID
-func generateSessionID() string {
-        b := make([]byte, 16)
-        _, err := rand.Read(b)
+        var err error
+        config, err = LoadConfig(*configPath)
         if err != nil {
-                // Handle error appropriately in a real application
-                panic(err)
+                log.Fatalf("Invalid configuration: %v", err)
+        }
+
+        templates = template.Must(template.ParseGlob(config.TemplateGlob))
+        if err := loadEmailTemplates(config.EmailTemplateDir); err != nil {
+                log.Fatal(err)
+        }
+
+        notifier, err = NewNotifier(config)
+        if err != nil {
+                log.Fatal(err)
         }
-        return fmt.Sprintf("%x", b)
-}
 
-func main() {
         // Database setup
-        var err error
-        db, err = sql.Open("sqlite3", "./db/chores.db")
+        db, err = sql.Open("sqlite3", config.DatabasePath)
         if err != nil {
                 log.Fatal(err)
         }
-        defer db.Close()
-
-        // Create tables if they don't exist
-	_, err = db.Exec(`
-          CREATE TABLE IF NOT EXISTS users (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            username TEXT UNIQUE NOT NULL,
-            hash TEXT NOT NULL,
-            email TEXT NOT NULL,
-            role TEXT NOT NULL,
-            points INTEGER DEFAULT 0
-          );
-
-          CREATE TABLE IF NOT EXISTS chores (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            name TEXT UNIQUE NOT NULL,
-            points INTEGER NOT NULL,
-            default_user_id INTEGER,
-            FOREIGN KEY (default_user_id) REFERENCES users(id)
-          );
-
-          CREATE TABLE IF NOT EXISTS daily_chores (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            user_id INTEGER NOT NULL,
-            chore_id INTEGER NOT NULL,
-            date DATE NOT NULL,
-            completed BOOLEAN DEFAULT FALSE,
-            FOREIGN KEY (user_id) REFERENCES users(id),
-            FOREIGN KEY (chore_id) REFERENCES chores(id)
-          );
-        `)
+
+        // Create or upgrade the tables
+        version, err := migrations.Run(db)
         if err != nil {
-		log.Fatalf("Failed to create tables: %v", err)
+		log.Fatalf("Failed to migrate database: %v", err)
         }
+	log.Printf("Database schema at version %d", version)
 
 	// Serve static files (CSS, JS, images, etc.)
-	fs := http.FileServer(http.Dir("./app/static"))
+	fs := http.FileServer(http.Dir(config.StaticDir))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
         // HTTP Handlers
         http.HandleFunc("/", indexHandler)
         http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/logout", logoutHandler)
-        http.HandleFunc("/user/create", createUserHandler)
-        http.HandleFunc("/chore/create", createChoreHandler)
-        http.HandleFunc("/chore/assign", assignChoreHandler)
-	http.HandleFunc("/chore/claim", claimChoreHandler)
-        http.HandleFunc("/chore/update", choreUpdateHandler)
+        http.HandleFunc("/user/create", requireRoleOrSetup(RoleParent)(createUserHandler))
+        http.HandleFunc("/chore/create", requireRole(RoleParent)(createChoreHandler))
+        http.HandleFunc("/chore/assign", requireRole(RoleParent)(assignChoreHandler))
+	http.HandleFunc("/chore/claim", requireRole(RoleParent, RoleChild)(claimChoreHandler))
+        http.HandleFunc("/chore/update", requireRole(RoleParent, RoleChild)(choreUpdateHandler))
 	http.HandleFunc("/chores", getChoresHandler)
 	http.HandleFunc("/points", getPointsHandler)
+	http.HandleFunc("/points/history", getPointsHistoryHandler)
+	http.HandleFunc("/review", requireRole(RoleParent)(reviewPageHandler))
+	http.HandleFunc("/review/pending", requireRole(RoleParent)(getPendingChoresHandler))
+	http.HandleFunc("/chore/review", requireRole(RoleParent)(reviewChoreHandler))
+	http.HandleFunc("/allowance", allowanceHandler)
+	http.HandleFunc("/rewards", rewardsHandler)
+	http.HandleFunc("/reward/create", requireRole(RoleParent)(createRewardHandler))
+	http.HandleFunc("/reward/update", requireRole(RoleParent)(updateRewardHandler))
+	http.HandleFunc("/reward/redeem", requireRole(RoleChild)(redeemRewardHandler))
+	http.HandleFunc("/reward/review", requireRole(RoleParent)(reviewRedemptionHandler))
+	http.HandleFunc("/allowance/settings", requireRole(RoleParent)(allowanceSettingsHandler))
+	http.HandleFunc("/allowance/payout", requireRole(RoleParent)(allowancePayoutHandler))
+	http.HandleFunc("/report", reportHandler)
+	http.HandleFunc("/notifications", requireRole(RoleParent)(notificationsHandler))
+	http.HandleFunc("/notifications/settings", requireRole(RoleParent)(notificationSettingsHandler))
+	http.HandleFunc("/manage", requireRole(RoleParent)(manageHandler))
+	http.HandleFunc("/user/edit", requireRole(RoleParent)(editUserHandler))
+	http.HandleFunc("/user/archive", requireRole(RoleParent)(archiveUserHandler))
+	http.HandleFunc("/user/delete", requireRole(RoleParent)(deleteUserHandler))
+	http.HandleFunc("/chore/edit", requireRole(RoleParent)(editChoreHandler))
+	http.HandleFunc("/chore/archive", requireRole(RoleParent)(archiveChoreHandler))
+	http.HandleFunc("/chore/delete", requireRole(RoleParent)(deleteChoreHandler))
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/server", requireRole(RoleParent)(serverHandler))
+	http.HandleFunc("/tokens", requireRole(RoleParent)(tokensHandler))
+	http.HandleFunc("/token/create", requireRole(RoleParent)(createTokenHandler))
+	http.HandleFunc("/token/revoke", requireRole(RoleParent)(revokeTokenHandler))
+	http.HandleFunc("/api/v1/users", apiHandler("users", apiUsersHandler))
+	http.HandleFunc("/api/v1/users/", apiHandler("users", apiUsersHandler))
+	http.HandleFunc("/api/v1/chores", apiHandler("chores", apiChoresHandler))
+	http.HandleFunc("/api/v1/chores/", apiHandler("chores", apiChoresHandler))
+	http.HandleFunc("/api/v1/daily_chores", apiHandler("daily_chores", apiDailyChoresHandler))
+	http.HandleFunc("/api/v1/daily_chores/", apiHandler("daily_chores", apiDailyChoresHandler))
+	http.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not found")
+	})
+
+        // Scheduled tasks (daily chore assignment, daily and weekly summaries, weekly allowance and reset)
+        if err := backfillDailyChores(db, householdNow()); err != nil {
+                log.Printf("Error backfilling daily chores: %v", err)
+        }
+        scheduler := NewScheduler(db)
+        for _, job := range scheduledJobs(db) {
+                if err := scheduler.Add(job); err != nil {
+                        log.Fatal(err)
+                }
+        }
 
+	// Background tasks run until SIGINT or SIGTERM (docker stop) cancels
+	// ctx, and are waited for before the database is closed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+	runInBackground := func(run func(ctx context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run(ctx)
+		}()
+	}
 
+	runInBackground(scheduler.Start)
+	runInBackground(func(ctx context.Context) { scheduleNotifications(ctx, db) })
 
+	// Keep the DNS records pointed at the server
+	if config.DynDNS.Enabled {
+		updater, err := NewDynDNSUpdater(db, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runInBackground(updater.Run)
+	}
 
-        // Scheduled tasks (daily and weekly summaries)
-        go scheduleDailySummary(db)
-        go scheduleWeeklySummary(db)
+	// Certificates are looked up on every handshake, so renewed ones are
+	// used without a restart
+	if config.ListenMode == ListenModeTLS {
+		certificates, err = NewCertSource(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runInBackground(certificates.Run)
+	}
 
-	// Start the HTTPS server
-	log.Println("Server starting on port 443")
-	log.Fatal(http.ListenAndServeTLS(":443",
-		"/app/certbot/config/live/"+os.Getenv("DUCKDNS_SUBDOMAIN")+
-			".duckdns.org/fullchain.pem",
-		"/app/certbot/config/live/"+os.Getenv("DUCKDNS_SUBDOMAIN")+
-			".duckdns.org/privkey.pem",
-		nil))
+	// Serve in the configured listen mode until shut down, then let the
+	// requests in flight and the background tasks finish
+	serveErr := serve(ctx, http.DefaultServeMux)
+	if serveErr != nil {
+		log.Printf("Server failed: %v", serveErr)
+	}
+	stop()
+	background.Wait()
+	if err := db.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+	if serveErr != nil {
+		os.Exit(1)
+	}
+	log.Print("Server stopped")
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -117,21 +182,8 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Assign chores to default owners if not already assigned
-    today := time.Now().Format("2006-01-02")
-    _, err := db.Exec(`
-        INSERT INTO daily_chores (user_id, chore_id, date)
-        SELECT c.default_user_id, c.id, ?
-        FROM chores c
-        LEFT JOIN daily_chores dc ON c.id = dc.chore_id AND dc.date = ?
-        WHERE dc.id IS NULL
-    `, today, today)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    // Get daily points for the preceding week
+    // Get daily points for the preceding week. Today's chores are assigned
+    // by the daily_chores job (see backfillDailyChores).
     dailyPoints, err := GetDailyPoints(db, user.ID, 7)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -145,15 +197,24 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 	
+    // Get the most recent reward redemptions
+    redemptions, err := GetRedemptions(db, user.ID, "", 10)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
     data := struct {
         User          *User
         DailyPoints   map[string]int
         WeeklyPoints  map[string]int
+        Redemptions   []Redemption
         CurrentUserID int
     }{
         User:          user,
         DailyPoints:   dailyPoints,
         WeeklyPoints:  weeklyPoints,
+        Redemptions:   redemptions,
         CurrentUserID: user.ID,
     }
 
@@ -168,14 +229,17 @@ func getCurrentUser(r *http.Request) *User {
         }
 
         sessionID := cookie.Value
-        userID, ok := sessions[sessionID]
-        if !ok {
-                return nil // Session ID not found
+        userID, err := LookupSession(db, sessionID)
+        if err != nil {
+                if err != errSessionNotFound {
+                        log.Printf("Error looking up session: %v", err)
+                }
+                return nil // Session ID not found or expired
         }
 
         // Fetch the user from the database
         user, err := GetUserByID(db, userID) // You'll need to implement GetUserByID
-        if err != nil {
+        if err != nil || user.Archived {
                 return nil // Error fetching user
         }
 
@@ -185,9 +249,9 @@ func getCurrentUser(r *http.Request) *User {
 
 // GetUserByID retrieves a user by their ID
 func GetUserByID(db *sql.DB, id int) (*User, error) {
-        row := db.QueryRow("SELECT id, username, hash, email, role, points FROM users WHERE id = ?", id)
+        row := db.QueryRow("SELECT id, username, hash, email, role, "+userBalanceSQL+", archived_at IS NOT NULL FROM users WHERE id = ?", id)
         var user User
-        err := row.Scan(&user.ID, &user.Username, &user.hash, &user.Email, &user.Role, &user.Points)
+        err := row.Scan(&user.ID, &user.Username, &user.hash, &user.Email, &user.Role, &user.Points, &user.Archived)
         if err != nil {
                 return nil, err
         }
@@ -201,24 +265,38 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
                 user, err := GetUserByUsername(db, username)
                 if err != nil {
+                        log.Printf("Failed login for %q from %s", username, r.RemoteAddr)
                         http.Error(w, "Invalid credentials", http.StatusUnauthorized)
                         return
                 }
-                if !CheckPasswordHash(password, user.hash) {
+                if user.Archived || !CheckPasswordHash(password, user.hash) {
+                        log.Printf("Failed login for %q from %s", username, r.RemoteAddr)
                         http.Error(w, "Invalid credentials", http.StatusUnauthorized)
                         return
                 }
 
+                // Never reuse a session from before the login
+                if cookie, err := r.Cookie("session_id"); err == nil {
+                        if err := DeleteSession(db, cookie.Value); err != nil {
+                                log.Printf("Error deleting previous session: %v", err)
+                        }
+                }
+
                 // Create a new session
-                sessionID := generateSessionID()
-                sessions[sessionID] = user.ID
+                sessionID, err := CreateSession(db, user.ID)
+                if err != nil {
+                        log.Printf("Error creating session: %v", err)
+                        http.Error(w, "Could not create session", http.StatusInternalServerError)
+                        return
+                }
 
                 // Set the session ID in a cookie
                 http.SetCookie(w, &http.Cookie{
                         Name:     "session_id",
                         Value:    sessionID,
+                        MaxAge:   int(sessionMaxLifetime.Seconds()),
                         HttpOnly: true,
-                        Secure:   true, // Should be true in production (requires HTTPS)
+                        Secure:   isHTTPS(r), // plain HTTP only in development
                         SameSite: http.SameSiteStrictMode,
                         Path:     "/",
                 })
@@ -239,8 +317,10 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 
         sessionID := cookie.Value
 
-        // Remove the session from the sessions map
-        delete(sessions, sessionID)
+        // Revoke the session on the server
+        if err := DeleteSession(db, sessionID); err != nil {
+                log.Printf("Error deleting session: %v", err)
+        }
 
         // Expire the session cookie in the browser
         http.SetCookie(w, &http.Cookie{
@@ -248,7 +328,7 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
                 Value:    "",
                 Expires:  time.Unix(0, 0),
                 HttpOnly: true,
-                Secure:   true, // Should be true in production (requires HTTPS)
+                Secure:   isHTTPS(r), // plain HTTP only in development
                 SameSite: http.SameSiteStrictMode,
                 Path:     "/",
         })
@@ -264,8 +344,23 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
                 password := r.FormValue("password")
                 email := r.FormValue("email")
                 role := r.FormValue("role")
+                if !validRole(role) {
+                        http.Error(w, "Invalid role", http.StatusBadRequest)
+                        return
+                }
 
-                err := CreateUser(db, username, password, email, role)
+                // The first account has to be able to manage everything else
+                count, err := countUsers(db)
+                if err != nil {
+                        http.Error(w, err.Error(), http.StatusInternalServerError)
+                        return
+                }
+                if count == 0 && role != RoleParent {
+                        http.Error(w, "The first user must be a parent", http.StatusBadRequest)
+                        return
+                }
+
+                err = CreateUser(db, username, password, email, role)
                 if err != nil {
                         http.Error(w, err.Error(), http.StatusInternalServerError)
                         return
@@ -292,17 +387,32 @@ func createChoreHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid default user ID", http.StatusBadRequest)
 			return
 		}
+		if !validDefaultUser(defaultUserID) {
+			http.Error(w, "Unknown default user", http.StatusBadRequest)
+			return
+		}
+		recurrence, err := parseRecurrenceForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		err = CreateChore(db, name, points, defaultUserID)
+		err = CreateChore(db, name, points, defaultUserID, recurrence)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		// Don't make a chore that is due today wait for the next scheduled run
+		if err := AssignDueChores(db, householdNow()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		// Redirect to a success page or back to the chore list
 		http.Redirect(w, r, "/", http.StatusFound)
 	} else {
-		userRows, err := db.Query("SELECT id, username FROM users")
+		userRows, err := db.Query("SELECT id, username FROM users WHERE archived_at IS NULL ORDER BY username")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -323,7 +433,6 @@ func createChoreHandler(w http.ResponseWriter, r *http.Request) {
 		templates.ExecuteTemplate(w, "create_chore.html", struct{ Users []User }{Users: users})
 	}
 }
-        // Render a form to create a chore (you'll need a corresponding HTML tem
 
 func assignChoreHandler(w http.ResponseWriter, r *http.Request) {
     if r.Method == "POST" {
@@ -355,7 +464,7 @@ func assignChoreHandler(w http.ResponseWriter, r *http.Request) {
         http.Redirect(w, r, "/", http.StatusFound)
     } else {
         // Get all users
-        userRows, err := db.Query("SELECT id, username FROM users")
+        userRows, err := db.Query("SELECT id, username FROM users WHERE archived_at IS NULL ORDER BY username")
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
@@ -373,7 +482,7 @@ func assignChoreHandler(w http.ResponseWriter, r *http.Request) {
         }
 
         // Get all chores
-        choreRows, err := db.Query("SELECT id, name FROM chores")
+        choreRows, err := db.Query("SELECT id, name FROM chores WHERE archived_at IS NULL ORDER BY name")
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
@@ -409,7 +518,7 @@ func getChoresHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    today := time.Now().Format("2006-01-02")
+    today := householdToday()
     allChores, err := fetchChoresData(db, user.ID, today)
     if err != nil {
         log.Printf("Error fetching chores data: %v", err)
@@ -428,25 +537,29 @@ func getChoresHandler(w http.ResponseWriter, r *http.Request) {
 func fetchChoresData(db *sql.DB, userID int, today string) ([]struct {
     ID          int
     Completed   bool
+    Status      string
+    ReviewNote  string
     Name        string
     Points      int
     UserID      sql.NullInt64
     IsAssigned  bool
     IsClaimable bool
 }, error) {
+    // Only chores due on the given date have a daily_chores row
     rows, err := db.Query(`
         SELECT
             c.id,
             dc.completed,
+            dc.status,
+            IFNULL(dc.review_note, ''),
             c.name,
             c.points,
             dc.user_id,
             CASE WHEN dc.user_id = ? THEN 1 ELSE 0 END AS is_assigned,
             CASE WHEN (dc.user_id <> ? OR dc.user_id IS NULL) AND (dc.completed = FALSE OR dc.completed IS NULL) THEN 1 ELSE 0 END AS is_claimable
         FROM chores c
-        LEFT JOIN daily_chores dc ON c.id = dc.chore_id AND dc.date = ?
-        WHERE (dc.user_id = ? OR dc.user_id IS NULL OR dc.user_id <> ?)
-    `, userID, userID, today, userID, userID)
+        JOIN daily_chores dc ON c.id = dc.chore_id AND dc.date = ?
+    `, userID, userID, today)
     if err != nil {
         return nil, fmt.Errorf("error getting chores: %v", err)
     }
@@ -455,6 +568,8 @@ func fetchChoresData(db *sql.DB, userID int, today string) ([]struct {
     var allChores []struct {
         ID          int
         Completed   bool
+        Status      string
+        ReviewNote  string
         Name        string
         Points      int
         UserID      sql.NullInt64
@@ -465,13 +580,15 @@ func fetchChoresData(db *sql.DB, userID int, today string) ([]struct {
         var chore struct {
             ID          int
             Completed   bool
+            Status      string
+            ReviewNote  string
             Name        string
             Points      int
             UserID      sql.NullInt64
             IsAssigned  bool
             IsClaimable bool
         }
-        if err := rows.Scan(&chore.ID, &chore.Completed, &chore.Name, &chore.Points, &chore.UserID, &chore.IsAssigned, &chore.IsClaimable); err != nil {
+        if err := rows.Scan(&chore.ID, &chore.Completed, &chore.Status, &chore.ReviewNote, &chore.Name, &chore.Points, &chore.UserID, &chore.IsAssigned, &chore.IsClaimable); err != nil {
             return nil, fmt.Errorf("error scanning chore: %v", err)
         }
         allChores = append(allChores, chore)
@@ -504,48 +621,28 @@ func choreUpdateHandler(w http.ResponseWriter, r *http.Request) {
     completedStr := r.FormValue("completed")
     completed := completedStr == "true" // Convert string to boolean
 
-    today := time.Now().Format("2006-01-02")
+    today := householdToday()
 
-    // Update the chore's completion status in the database
-    _, err = db.Exec(`
-        UPDATE daily_chores
-        SET completed = ?
-        WHERE user_id = ? AND chore_id = ? AND date = ?
-    `, completed, user.ID, choreID, today)
-    if err != nil {
-        log.Printf("Error updating chore completion status: %v", err)
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    // Update the chore's completion status; points are credited on approval
+    err = MarkChoreCompleted(db, user, user, choreID, today, completed)
+    switch err {
+    case nil:
+    case errChoreNotAssigned:
+        http.Error(w, err.Error(), http.StatusNotFound)
         return
-    }
-
-    // Adjust points based on completion status
-    var points int
-    err = db.QueryRow(`
-        SELECT points FROM chores WHERE id = ?
-    `, choreID).Scan(&points)
-    if err != nil {
-        log.Printf("Error getting chore points: %v", err)
+    case errChoreAlreadyApproved:
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    default:
+        log.Printf("Error updating chore completion status: %v", err)
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
     if completed {
-        // Add points if chore is marked as completed
-        _, err = db.Exec(`
-            UPDATE users SET points = points + ?
-            WHERE id = ?
-        `, points, user.ID)
-    } else {
-        // Subtract points if chore is marked as incomplete
-        _, err = db.Exec(`
-            UPDATE users SET points = points - ?
-            WHERE id = ?
-        `, points, user.ID)
-    }
-    if err != nil {
-        log.Printf("Error updating user points: %v", err)
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+        if err := QueueChoreCompleted(db, user, choreID, today); err != nil {
+            log.Printf("Error queueing chore completed notification: %v", err)
+        }
     }
 
     // Fetch updated chores data
@@ -584,13 +681,17 @@ func claimChoreHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    today := time.Now().Format("2006-01-02")
+    today := householdToday()
 
 	
-    // Use REPLACE INTO to insert or replace the chore assignment
+    // Take over the chore assignment unless it is already done, keeping the
+    // row (and the ledger entries pointing at it) in place
     _, err = db.Exec(`
-        REPLACE INTO daily_chores (user_id, chore_id, date)
+        INSERT INTO daily_chores (user_id, chore_id, date)
         VALUES (?, ?, ?)
+        ON CONFLICT (chore_id, date) DO UPDATE
+        SET user_id = excluded.user_id, status = 'open', review_note = NULL
+        WHERE daily_chores.completed = FALSE
     `, user.ID, choreID, today)
     if err != nil {
         log.Printf("Error inserting or replacing chore: %v", err)
@@ -622,20 +723,12 @@ func getPointsHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	//    today := time.Now().Format("2006-01-02")
-
     // Get daily points for the preceding week
     dailyPoints := make(map[string]int)
     dailyData := make([]int, 7)
     for i := 0; i < 7; i++ {
-        date := time.Now().AddDate(0, 0, -i).Format("2006-01-02")
-        var points int
-        err := db.QueryRow(`
-            SELECT IFNULL(SUM(c.points), 0)
-            FROM daily_chores dc
-            JOIN chores c ON dc.chore_id = c.id
-            WHERE dc.user_id = ? AND dc.date = ? AND dc.completed = TRUE
-        `, user.ID, date).Scan(&points)
+        date := householdNow().AddDate(0, 0, -i).Format("2006-01-02")
+        points, err := pointsEarnedBetween(db, user.ID, date, date)
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
@@ -648,15 +741,9 @@ func getPointsHandler(w http.ResponseWriter, r *http.Request) {
     weeklyPoints := make(map[string]int)
     weeklyData := make([]int, 4)
     for i := 0; i < 4; i++ {
-        startDate := time.Now().AddDate(0, 0, -i*7 - 6).Format("2006-01-02")
-        endDate := time.Now().AddDate(0, 0, -i*7).Format("2006-01-02")
-        var points int
-        err := db.QueryRow(`
-            SELECT IFNULL(SUM(c.points), 0)
-            FROM daily_chores dc
-            JOIN chores c ON dc.chore_id = c.id
-            WHERE dc.user_id = ? AND dc.date BETWEEN ? AND ? AND dc.completed = TRUE
-        `, user.ID, startDate, endDate).Scan(&points)
+        startDate := householdNow().AddDate(0, 0, -i*7 - 6).Format("2006-01-02")
+        endDate := householdNow().AddDate(0, 0, -i*7).Format("2006-01-02")
+        points, err := pointsEarnedBetween(db, user.ID, startDate, endDate)
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
@@ -680,198 +767,168 @@ func getPointsHandler(w http.ResponseWriter, r *http.Request) {
 
 // Email functions
 
-func sendChoreCompletionEmail(user *User, choreName string) {
-        // Construct email message
-        from := "your_email@example.com" // Replace with your email
-        password := "your_app_password"    // Replace with your app password
-        to := []string{"parent_email@example.com"} // Replace with parent's email
-        subject := "Chore Completed: " + choreName
-        body := fmt.Sprintf("Hello,\n\n%s has completed the chore: %s\n\n", user.Username, choreName)
-
-        msg := []byte("To: " + to[0] + "\r\n" +
-                "Subject: " + subject + "\r\n" +
-                "\r\n" +
-                body + "\r\n")
-
-        // SMTP authentication
-        auth := smtp.PlainAuth("", from, password, "smtp.gmail.com")
-
-        // Send email
-        err := smtp.SendMail("smtp.gmail.com:587", auth, from, to, msg)
-        if err != nil {
-                log.Printf("Error sending email: %v", err)
+// sendChoreCompletionEmail tells a parent about chores completed since the
+// last notification
+func sendChoreCompletionEmail(parent *User, events []ChoreEvent) error {
+        subject := fmt.Sprintf("%d Chores Completed", len(events))
+        if len(events) == 1 {
+                subject = "Chore Completed: " + events[0].ChoreName
         }
-}
-
-func scheduleDailySummary(db *sql.DB) {
-        // Set the time for the first execution (e.g., 11:59 PM)
-        firstExecution := time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 23, 59, 0, 0, time.Local)
-        if time.Now().After(firstExecution) {
-                // If it's already past 11:59 PM today, schedule for tomorrow
-                firstExecution = firstExecution.Add(24 * time.Hour)
+        body := "Hello,\n\n"
+        for _, event := range events {
+                body += fmt.Sprintf("%s has completed the chore: %s (%s)\n", event.ChildName, event.ChoreName, event.Date)
         }
 
-        durationUntilFirstExecution := firstExecution.Sub(time.Now())
-
-        // Wait until the first execution time
-        time.Sleep(durationUntilFirstExecution)
-
-        // Execute the first task
-        sendDailySummaryEmails(db)
-
-        // Schedule the task to run every 24 hours
-        ticker := time.NewTicker(24 * time.Hour)
-        defer ticker.Stop()
+        return notifier.Notify(Message{
+                To:      []string{parent.Email},
+                Subject: subject,
+                Body:    body,
+        })
+}
 
-        for range ticker.C {
-                sendDailySummaryEmails(db)
+// scheduledJobs returns the jobs run by the scheduler. Their schedules can
+// be changed with the schedules setting in the config.
+func scheduledJobs(db *sql.DB) []Job {
+        // Weekly jobs run late on the last day of the week
+        lastDay := (config.FirstWeekday() + 6) % 7
+        endOfWeek := fmt.Sprintf("59 23 * * %d", lastDay)
+
+        return []Job{
+                {
+                        Name:     "daily_chores",
+                        Schedule: "0 0 * * *",
+                        Run:      func(at time.Time) error { return backfillDailyChores(db, at) },
+                },
+                {
+                        Name:     "daily_summary",
+                        Schedule: "59 23 * * *",
+                        Run:      func(at time.Time) error { return sendDailySummaryEmails(db, at) },
+                },
+                {
+                        // Credited in the job's transaction, so a failed run is retried
+                        // rather than lost
+                        Name:     "weekly_allowance",
+                        Schedule: endOfWeek,
+                        RunTx:    CreditWeeklyAllowance,
+                },
+                {
+                        // Best effort: the run is marked before it starts and not
+                        // retried, so nobody gets the report twice. A recipient whose
+                        // email fails is logged and skipped. Registered after the
+                        // allowance so the report shows it.
+                        Name:     "weekly_summary",
+                        Schedule: endOfWeek,
+                        Run:      func(at time.Time) error { return sendWeeklySummaryEmails(db, at) },
+                },
+                {
+                        // Registered after the allowance and the summary, which both
+                        // read the week's points, so it runs after them
+                        Name:     "weekly_reset",
+                        Schedule: endOfWeek,
+                        RunTx:    func(tx *sql.Tx, at time.Time) error { return ResetWeeklyPoints(tx) },
+                },
         }
 }
 
-func sendDailySummaryEmails(db *sql.DB) {
+// sendDailySummaryEmails sends everyone the chores completed on the day of at
+func sendDailySummaryEmails(db *sql.DB, at time.Time) error {
         // Get all users
-        rows, err := db.Query("SELECT id, username, email, points FROM users")
+        rows, err := db.Query("SELECT id, username, email, role FROM users WHERE archived_at IS NULL")
         if err != nil {
-                log.Printf("Error fetching users: %v", err)
-                return
+                return fmt.Errorf("error fetching users: %v", err)
         }
         defer rows.Close()
 
         var users []User
         for rows.Next() {
                 var user User
-                if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Points); err != nil {
-                        log.Printf("Error scanning user: %v", err)
-                        continue
+                if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role); err != nil {
+                        return fmt.Errorf("error scanning user: %v", err)
                 }
                 users = append(users, user)
         }
 
+        // Get today's points from the ledger
+        today := at.Format("2006-01-02")
+        earnedToday := make(map[int]int)
+        for _, user := range users {
+                earned, err := pointsEarnedBetween(db, user.ID, today, today)
+                if err != nil {
+                        return fmt.Errorf("error fetching points for %s: %v", user.Username, err)
+                }
+                earnedToday[user.ID] = earned
+        }
+
         // Get today's completed chores
-        today := time.Now().Format("2006-01-02")
         choreRows, err := db.Query(`
         SELECT dc.user_id, u.username, c.name, c.points
         FROM daily_chores dc
         JOIN users u ON dc.user_id = u.id
         JOIN chores c ON dc.chore_id = c.id
-        WHERE dc.date = ? AND dc.completed = TRUE`, today)
+        WHERE dc.date = ? AND dc.status = 'approved'`, today)
         if err != nil {
-                log.Printf("Error fetching daily chores: %v", err)
-                return
+                return fmt.Errorf("error fetching daily chores: %v", err)
         }
         defer choreRows.Close()
 
         // Create a map to store each user's completed chores
-        userChores := make(map[int][]struct {
-                Username   string
-                ChoreName  string
-                ChorePoints int
-        })
+        userChores := make(map[int][]SummaryChore)
 
         for choreRows.Next() {
                 var userID int
                 var username, choreName string
                 var chorePoints int
                 if err := choreRows.Scan(&userID, &username, &choreName, &chorePoints); err != nil {
-                        log.Printf("Error scanning daily chore: %v", err)
-                        continue
+                        return fmt.Errorf("error scanning daily chore: %v", err)
                 }
-                userChores[userID] = append(userChores[userID], struct {
-                        Username   string
-                        ChoreName  string
-                        ChorePoints int
-                }{username, choreName, chorePoints})
+                userChores[userID] = append(userChores[userID], SummaryChore{choreName, chorePoints})
         }
 
         // Send email to each user
         for _, user := range users {
-                var body string
-                if user.Role == "child" {
-                        body = fmt.Sprintf("Hello %s,\n\n", user.Username)
-                        if chores, ok := userChores[user.ID]; ok {
-                                body += "Here are the chores you completed today:\n"
-                                for _, chore := range chores {
-                                        body += fmt.Sprintf("- %s (%d points)\n", chore.ChoreName, chore.ChorePoints)
-                                }
-                                body += fmt.Sprintf("\nTotal points earned today: %d\n", user.Points)
-                        } else {
-                                body += "You did not complete any chores today.\n"
-                        }
-                } else if user.Role == "parent" {
-                        body = "Hello,\n\nHere is the summary of completed chores today:\n"
-                        for _, user := range users {
-                                if user.Role == "child" {
-                                        body += fmt.Sprintf("\n%s:\n", user.Username)
-                                        if chores, ok := userChores[user.ID]; ok {
-                                                for _, chore := range chores {
-                                                        body += fmt.Sprintf("- %s (%d points)\n", chore.ChoreName, chore.ChorePoints)
-                                                }
-                                                body += fmt.Sprintf("Total points earned today: %d\n", user.Points)
-                                        } else {
-                                                body += "No chores completed today.\n"
-                                        }
-                                }
-                        }
-                }
-
-                // Send email
-                if body != "" {
-                        from := "your_email@example.com"
-                        password := "your_password"
-                        to := []string{user.Email}
-                        subject := "Daily Chore Summary"
-
-                        msg := []byte("To: " + to[0] + "\r\n" +
-                                "Subject: " + subject + "\r\n" +
-                                "\r\n" +
-                                body + "\r\n")
-
-                        auth := smtp.PlainAuth("", from, password, "smtp.gmail.com")
-
-                        err := smtp.SendMail("smtp.gmail.com:587", auth, from, to, msg)
-                        if err != nil {
-                                log.Printf("Error sending email to %s: %v", user.Email, err)
+                email := SummaryEmail{Recipient: user, IsParent: user.Role == RoleParent}
+                for _, child := range users {
+                        if child.Role == RoleChild && (email.IsParent || child.ID == user.ID) {
+                                email.Children = append(email.Children, ChildSummary{
+                                        Username: child.Username,
+                                        Chores:   userChores[child.ID],
+                                        Points:   earnedToday[child.ID],
+                                })
                         }
                 }
+                sendSummaryEmail(user, "Daily Chore Summary", "daily_summary", email)
         }
+        return nil
 }
 
-func scheduleWeeklySummary(db *sql.DB) {
-        // Calculate the time for the first execution (e.g., Sunday at 11:59 PM)
-        now := time.Now()
-        daysUntilSunday := int(time.Sunday - now.Weekday())
-        if daysUntilSunday < 0 {
-                daysUntilSunday += 7 // If today is Sunday, the difference will be 0
-        }
-        firstExecution := time.Date(now.Year(), now.Month(), now.Day()+daysUntilSunday, 23, 59, 0, 0, time.Local)
-        if now.After(firstExecution) {
-                // If it's already past the first execution time this week, schedule for next week
-                firstExecution = firstExecution.AddDate(0, 0, 7)
+// sendSummaryEmail renders a summary email template for the user and sends it
+func sendSummaryEmail(user User, subject, template string, email SummaryEmail) {
+        if !hasRole(&user, RoleParent, RoleChild) {
+                return
         }
 
-        durationUntilFirstExecution := firstExecution.Sub(now)
-
-        // Wait until the first execution time
-        time.Sleep(durationUntilFirstExecution)
-
-        // Execute the first task
-        sendWeeklySummaryEmails(db)
-
-        // Schedule the task to run every week
-        ticker := time.NewTicker(7 * 24 * time.Hour)
-        defer ticker.Stop()
+        msg := Message{
+                To:      []string{user.Email},
+                Subject: subject,
+        }
+        if err := renderEmail(&msg, template, email); err != nil {
+                log.Printf("Error rendering %s email for %s: %v", template, user.Username, err)
+                return
+        }
 
-        for range ticker.C {
-                sendWeeklySummaryEmails(db)
+        err := notifier.Notify(msg)
+        if err != nil {
+                log.Printf("Error sending email to %s: %v", user.Email, err)
         }
 }
 
-func sendWeeklySummaryEmails(db *sql.DB) {
+// sendWeeklySummaryEmails sends everyone the report of the week that ended
+// on the day of at. The allowance is credited by the weekly_allowance job.
+func sendWeeklySummaryEmails(db *sql.DB, at time.Time) error {
         // Get all users
-        rows, err := db.Query("SELECT id, username, email, role FROM users")
+        rows, err := db.Query("SELECT id, username, email, role FROM users WHERE archived_at IS NULL")
         if err != nil {
-                log.Printf("Error fetching users: %v", err)
-                return
+                return fmt.Errorf("error fetching users: %v", err)
         }
         defer rows.Close()
 
@@ -879,136 +936,33 @@ func sendWeeklySummaryEmails(db *sql.DB) {
         for rows.Next() {
                 var user User
                 if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role); err != nil {
-                        log.Printf("Error scanning user: %v", err)
-                        continue
+                        return fmt.Errorf("error scanning user: %v", err)
                 }
                 users = append(users, user)
         }
+        if err := rows.Err(); err != nil {
+                return fmt.Errorf("error fetching users: %v", err)
+        }
 
-        // Calculate start and end of the last week
-        now := time.Now()
-        endOfWeek := now.AddDate(0, 0, -int(now.Weekday()))            // Go back to the last Sunday
-        startOfWeek := endOfWeek.AddDate(0, 0, -6)                     // Go back 6 more days for the start of the week
-        formattedStartOfWeek := startOfWeek.Format("2006-01-02")
-        formattedEndOfWeek := endOfWeek.Format("2006-01-02")
+        startOfWeek := lastCompleteWeek(at, config.FirstWeekday())
 
-        // Get the last week's completed chores
-        choreRows, err := db.Query(`
-        SELECT dc.user_id, u.username, c.name, c.points, dc.date
-        FROM daily_chores dc
-        JOIN users u ON dc.user_id = u.id
-        JOIN chores c ON dc.chore_id = c.id
-        WHERE dc.date BETWEEN ? AND ? AND dc.completed = TRUE`, formattedStartOfWeek, formattedEndOfWeek)
+        children, err := getChildren(db)
         if err != nil {
-                log.Printf("Error fetching weekly chores: %v", err)
-                return
+                return fmt.Errorf("error fetching children: %v", err)
         }
-        defer choreRows.Close()
-
-        // Create a map to store each user's weekly completed chores
-        userWeeklyChores := make(map[int]map[string][]struct {
-                ChoreName  string
-                ChorePoints int
-        })
-
-        for choreRows.Next() {
-                var userID int
-                var username, choreName, choreDate string
-                var chorePoints int
-                if err := choreRows.Scan(&userID, &username, &choreName, &chorePoints, &choreDate); err != nil {
-                        log.Printf("Error scanning weekly chore: %v", err)
-                        continue
-                }
-
-                // Initialize the map for the user and date if it doesn't exist
-                if _, ok := userWeeklyChores[userID]; !ok {
-                        userWeeklyChores[userID] = make(map[string][]struct {
-                                ChoreName  string
-                                ChorePoints int
-                        })
-                }
-                if _, ok := userWeeklyChores[userID][choreDate]; !ok {
-                        userWeeklyChores[userID][choreDate] = []struct {
-                                ChoreName  string
-                                ChorePoints int
-                        }{}
-                }
-
-                userWeeklyChores[userID][choreDate] = append(userWeeklyChores[userID][choreDate], struct {
-                        ChoreName  string
-                        ChorePoints int
-                }{choreName, chorePoints})
+        report, err := BuildWeeklyReport(db, startOfWeek, children)
+        if err != nil {
+                return fmt.Errorf("error building weekly report: %v", err)
         }
 
         // Send email to each user
         for _, user := range users {
-                var body string
-                if user.Role == "child" {
-                        body = fmt.Sprintf("Hello %s,\n\n", user.Username)
-                        weeklyPoints := 0
-                        if weeklyChores, ok := userWeeklyChores[user.ID]; ok {
-                                body += "Here are the chores you completed last week:\n\n"
-                                for date, chores := range weeklyChores {
-                                        body += fmt.Sprintf("%s:\n", date)
-                                        for _, chore := range chores {
-                                                body += fmt.Sprintf("- %s (%d points)\n", chore.ChoreName, chore.ChorePoints)
-                                                weeklyPoints += chore.ChorePoints
-                                        }
-                                        body += "\n"
-                                }
-                                body += fmt.Sprintf("Total points earned last week: %d\n", weeklyPoints)
-                                body += fmt.Sprintf("Total allowance earned last week: $%.2f\n", float64(weeklyPoints)*0.1) // Assuming 1 point = $0.1
-                        } else {
-                                body += "You did not complete any chores last week.\n"
-                        }
-                } else if user.Role == "parent" {
-                        body = "Hello,\n\nHere is the summary of completed chores last week:\n\n"
-                        for _, child := range users {
-                                if child.Role == "child" {
-                                        body += fmt.Sprintf("%s:\n", child.Username)
-                                        weeklyPoints := 0
-                                        if weeklyChores, ok := userWeeklyChores[child.ID]; ok {
-                                                for date, chores := range weeklyChores {
-                                                        body += fmt.Sprintf("%s:\n", date)
-                                                        for _, chore := range chores {
-                                                                body += fmt.Sprintf("- %s (%d points)\n", chore.ChoreName, chore.ChorePoints)
-                                                                weeklyPoints += chore.ChorePoints
-                                                        }
-                                                        body += "\n"
-                                                }
-                                                body += fmt.Sprintf("Total points earned last week: %d\n", weeklyPoints)
-                                                body += fmt.Sprintf("Total allowance earned last week: $%.2f\n\n", float64(weeklyPoints)*0.1) // Assuming 1 point = $0.1
-                                        } else {
-                                                body += "No chores completed last week.\n\n"
-                                        }
-                                }
-                        }
-                }
-
-                // Send email
-                if body != "" {
-                        from := "your_email@example.com"
-                        password := "your_password"
-                        to := []string{user.Email}
-                        subject := "Weekly Chore Summary"
-
-                        msg := []byte("To: " + to[0] + "\r\n" +
-                                "Subject: " + subject + "\r\n" +
-                                "\r\n" +
-                                body + "\r\n")
-
-                        auth := smtp.PlainAuth("", from, password, "smtp.gmail.com")
-
-                        err := smtp.SendMail("smtp.gmail.com:587", auth, from, to, msg)
-                        if err != nil {
-                                log.Printf("Error sending email to %s: %v", user.Email, err)
-                        }
+                email := SummaryEmail{Recipient: user, IsParent: user.Role == RoleParent, Week: report}
+                if !email.IsParent {
+                        email.Week = report.forChild(user.ID)
                 }
+                sendSummaryEmail(user, "Weekly Chore Summary", "weekly_summary", email)
         }
 
-        // Reset points for all users at the end of the week
-        _, err = db.Exec("UPDATE users SET points = 0")
-        if err != nil {
-                log.Printf("Error resetting user points: %v", err)
-        }
+        return nil
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// The manage page lists all users and chores for parents to edit, archive
+// and delete. Deleting a user or chore with a history archives it instead,
+// so past daily chores and points stay intact.
+
+// manageHandler shows all users and chores, archived ones included
+func manageHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := GetUsers(db)
+	if err != nil {
+		log.Printf("Error fetching users: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chores, err := GetChores(db)
+	if err != nil {
+		log.Printf("Error fetching chores: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	usernames := make(map[int]string)
+	for _, u := range users {
+		usernames[u.ID] = u.Username
+	}
+
+	data := struct {
+		Users     []User
+		Chores    []Chore
+		Usernames map[int]string
+	}{
+		Users:     users,
+		Chores:    chores,
+		Usernames: usernames,
+	}
+	templates.ExecuteTemplate(w, "manage.html", data)
+}
+
+// editUserHandler shows the form to edit a user and saves it. The password
+// is only changed if a new one is entered.
+func editUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	target, err := GetUserByID(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "POST" {
+		templates.ExecuteTemplate(w, "edit_user.html", struct{ Target *User }{Target: target})
+		return
+	}
+
+	oldRole := target.Role
+	target.Username = r.FormValue("username")
+	target.Email = r.FormValue("email")
+	target.Role = r.FormValue("role")
+	if target.Username == "" {
+		http.Error(w, "Username can't be empty", http.StatusBadRequest)
+		return
+	}
+	if !validRole(target.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if oldRole == RoleParent && target.Role != RoleParent {
+		if !checkParentRemains(w, id) {
+			return
+		}
+	}
+
+	if err := UpdateUser(db, target, r.FormValue("password")); err != nil {
+		log.Printf("Error updating user: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if target.Role != oldRole || r.FormValue("password") != "" {
+		// Sessions were granted for the old role or password
+		if err := RevokeUserSessions(db, id); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+		}
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
+
+// archiveUserHandler archives a user, or restores them if archived=false
+func archiveUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseManageForm(w, r, "user_id")
+	if !ok {
+		return
+	}
+
+	var err error
+	if r.FormValue("archived") == "false" {
+		err = RestoreUser(db, id)
+		if err == nil {
+			err = AssignDueChores(db, householdNow())
+		}
+	} else {
+		if !checkUserRemovable(w, r, id) {
+			return
+		}
+		err = ArchiveUser(db, id)
+	}
+	finishManageAction(w, r, err, "archiving user")
+}
+
+// deleteUserHandler deletes a user, or archives them if they have a history
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseManageForm(w, r, "user_id")
+	if !ok || !checkUserRemovable(w, r, id) {
+		return
+	}
+	_, err := RemoveUser(db, id)
+	finishManageAction(w, r, err, "deleting user")
+}
+
+// editChoreHandler shows the form to edit a chore and saves it. Points
+// already credited for the chore don't change.
+func editChoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid chore ID", http.StatusBadRequest)
+		return
+	}
+	chore, err := GetChore(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Chore not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching chore: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "POST" {
+		users, err := GetUsers(db)
+		if err != nil {
+			log.Printf("Error fetching users: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := struct {
+			Chore *Chore
+			Users []User
+		}{
+			Chore: chore,
+			Users: users,
+		}
+		templates.ExecuteTemplate(w, "edit_chore.html", data)
+		return
+	}
+
+	chore.Name = r.FormValue("name")
+	if chore.Name == "" {
+		http.Error(w, "Chore name can't be empty", http.StatusBadRequest)
+		return
+	}
+	chore.Points, err = strconv.Atoi(r.FormValue("points"))
+	if err != nil {
+		http.Error(w, "Invalid points value", http.StatusBadRequest)
+		return
+	}
+	defaultUserID, err := strconv.Atoi(r.FormValue("default_user_id"))
+	if err != nil {
+		http.Error(w, "Invalid default user ID", http.StatusBadRequest)
+		return
+	}
+	// The form offers the current default user even if they were archived since
+	if defaultUserID != chore.DefaultUserID && !validDefaultUser(defaultUserID) {
+		http.Error(w, "Unknown default user", http.StatusBadRequest)
+		return
+	}
+	chore.DefaultUserID = defaultUserID
+	chore.Recurrence, err = parseRecurrenceForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := UpdateChore(db, *chore); err != nil {
+		log.Printf("Error updating chore: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A new schedule or default user may make the chore due today
+	if err := AssignDueChores(db, householdNow()); err != nil {
+		log.Printf("Error assigning due chores: %v", err)
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
+
+// validDefaultUser reports whether id can be made a chore's default user:
+// 0 for nobody, or a user who exists and isn't archived
+func validDefaultUser(id int) bool {
+	if id == 0 {
+		return true
+	}
+	_, err := activeUser(id)
+	return err == nil
+}
+
+// archiveChoreHandler archives a chore, or restores it if archived=false
+func archiveChoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseManageForm(w, r, "chore_id")
+	if !ok {
+		return
+	}
+
+	var err error
+	if r.FormValue("archived") == "false" {
+		err = RestoreChore(db, id)
+		if err == nil {
+			err = AssignDueChores(db, householdNow())
+		}
+	} else {
+		err = ArchiveChore(db, id)
+	}
+	finishManageAction(w, r, err, "archiving chore")
+}
+
+// deleteChoreHandler deletes a chore, or archives it if it has been
+// assigned before
+func deleteChoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseManageForm(w, r, "chore_id")
+	if !ok {
+		return
+	}
+	_, err := RemoveChore(db, id)
+	finishManageAction(w, r, err, "deleting chore")
+}
+
+// parseManageForm checks that the request is a POST and returns the ID in
+// the given form field
+func parseManageForm(w http.ResponseWriter, r *http.Request, field string) (int, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+	id, err := strconv.Atoi(r.FormValue(field))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// checkUserRemovable writes an error and returns false if the user is the
+// current user or the last parent
+func checkUserRemovable(w http.ResponseWriter, r *http.Request, id int) bool {
+	if user := getCurrentUser(r); user != nil && user.ID == id {
+		http.Error(w, "You can't remove yourself", http.StatusConflict)
+		return false
+	}
+	return checkParentRemains(w, id)
+}
+
+// checkParentRemains writes an error and returns false if the user is the
+// last active parent
+func checkParentRemains(w http.ResponseWriter, id int) bool {
+	target, err := GetUserByID(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if err == nil && target.Role == RoleParent {
+		err = checkOtherParents(db, id)
+	}
+	if err == errLastParent {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error counting parents: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// finishManageAction reports err or goes back to the manage page
+func finishManageAction(w http.ResponseWriter, r *http.Request, err error, context string) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error %s: %v", context, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/manage", http.StatusFound)
+}
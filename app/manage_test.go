@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestValidDefaultUser(t *testing.T) {
+	db := newTestDB(t)
+	active := addTestUser(t, db, "active", RoleChild)
+	archived := addTestUser(t, db, "archived", RoleChild)
+	if _, err := db.Exec("UPDATE users SET archived_at = 1 WHERE id = ?", archived); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   int
+		want bool
+	}{
+		{"nobody", 0, true},
+		{"active user", active, true},
+		{"archived user", archived, false},
+		{"unknown user", archived + 1, false},
+	}
+	for _, tt := range tests {
+		if got := validDefaultUser(tt.id); got != tt.want {
+			t.Errorf("%s: validDefaultUser(%d) = %v, want %v", tt.name, tt.id, got, tt.want)
+		}
+	}
+}
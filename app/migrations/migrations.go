@@ -0,0 +1,408 @@
+// Package migrations keeps the chore tracker's SQLite schema up to date.
+//
+// Every change to the schema is a numbered migration. Applied migrations are
+// recorded in the schema_version table, so Run only applies the ones a
+// database is missing. Migrations are written to also work on databases
+// created before the migrations existed, when the server created its tables
+// with CREATE TABLE IF NOT EXISTS. Never edit a migration once released; add
+// a new one instead.
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration is one step of the schema history
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// All lists every migration in the order they are applied
+var All = []Migration{
+	{1, "initial schema", exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			hash TEXT NOT NULL,
+			email TEXT NOT NULL,
+			role TEXT NOT NULL,
+			points INTEGER DEFAULT 0 -- unused since migration 6, balances come from points_transactions
+		);
+
+		CREATE TABLE IF NOT EXISTS chores (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			points INTEGER NOT NULL,
+			default_user_id INTEGER,
+			FOREIGN KEY (default_user_id) REFERENCES users(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS daily_chores (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			chore_id INTEGER NOT NULL,
+			date DATE NOT NULL,
+			completed BOOLEAN DEFAULT FALSE,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (chore_id) REFERENCES chores(id)
+		);
+	`)},
+
+	{2, "chore recurrence", addColumn("chores", "recurrence", "TEXT NOT NULL DEFAULT 'daily'")},
+
+	// One assignment per chore and day; drop duplicates left by older
+	// versions before enforcing it, keeping the most recent claim
+	{3, "unique daily chores", exec(`
+		DELETE FROM daily_chores
+		WHERE id NOT IN (SELECT MAX(id) FROM daily_chores GROUP BY chore_id, date);
+
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_daily_chores_chore_date
+			ON daily_chores (chore_id, date);
+	`)},
+
+	{4, "sessions", exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY, -- SHA-256 of the session token, never the token itself
+			user_id INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			last_seen_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+	`)},
+
+	{5, "chore review", func(tx *sql.Tx) error {
+		// status is open, pending, approved or rejected
+		added, err := addColumnIfMissing(tx, "daily_chores", "status", "TEXT NOT NULL DEFAULT 'open'")
+		if err != nil {
+			return err
+		}
+		if added {
+			// Points for chores completed so far have already been credited
+			if _, err := tx.Exec("UPDATE daily_chores SET status = 'approved' WHERE completed = TRUE"); err != nil {
+				return err
+			}
+		}
+		return all(
+			addColumn("daily_chores", "review_note", "TEXT"),
+			addColumn("daily_chores", "reviewed_by", "INTEGER"),
+			addColumn("daily_chores", "reviewed_at", "INTEGER"),
+		)(tx)
+	}},
+
+	{6, "points ledger", all(
+		exec(`
+			CREATE TABLE IF NOT EXISTS points_transactions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				amount INTEGER NOT NULL,
+				source TEXT NOT NULL, -- opening_balance, chore, weekly_reset, reward, reward_refund or allowance
+				chore_id INTEGER,
+				daily_chore_id INTEGER,
+				actor_id INTEGER,
+				note TEXT,
+				created_at INTEGER NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (chore_id) REFERENCES chores(id),
+				FOREIGN KEY (daily_chore_id) REFERENCES daily_chores(id),
+				FOREIGN KEY (actor_id) REFERENCES users(id)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_points_transactions_user
+				ON points_transactions (user_id);
+		`),
+		// Carry balances kept in users.points over into a fresh ledger
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				INSERT INTO points_transactions (user_id, amount, source, created_at)
+				SELECT id, points, 'opening_balance', ?
+				FROM users
+				WHERE points <> 0 AND NOT EXISTS (SELECT 1 FROM points_transactions)
+			`, time.Now().Unix())
+			return err
+		},
+	)},
+
+	{7, "allowance", exec(`
+		CREATE TABLE IF NOT EXISTS allowance_settings (
+			user_id INTEGER PRIMARY KEY,
+			cents_per_point INTEGER NOT NULL DEFAULT 10,
+			currency TEXT NOT NULL DEFAULT 'USD',
+			weekly_cap_cents INTEGER NOT NULL DEFAULT 0, -- 0 means no cap
+			minimum_payout_cents INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS allowance_transactions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			amount_cents INTEGER NOT NULL,
+			kind TEXT NOT NULL, -- earned or payout
+			week_start DATE, -- earned: first day of the week the points were earned
+			points INTEGER,
+			actor_id INTEGER,
+			note TEXT,
+			created_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (actor_id) REFERENCES users(id)
+		);
+
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_allowance_earned_week
+			ON allowance_transactions (user_id, week_start) WHERE kind = 'earned';
+	`)},
+
+	{8, "rewards", exec(`
+		CREATE TABLE IF NOT EXISTS rewards (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			cost INTEGER NOT NULL,
+			requires_approval BOOLEAN NOT NULL DEFAULT FALSE,
+			active BOOLEAN NOT NULL DEFAULT TRUE
+		);
+
+		CREATE TABLE IF NOT EXISTS reward_redemptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			reward_id INTEGER NOT NULL,
+			cost INTEGER NOT NULL, -- points paid, the reward's cost may change later
+			status TEXT NOT NULL, -- pending, approved or rejected
+			note TEXT,
+			created_at INTEGER NOT NULL,
+			reviewed_by INTEGER,
+			reviewed_at INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (reward_id) REFERENCES rewards(id),
+			FOREIGN KEY (reviewed_by) REFERENCES users(id)
+		);
+	`)},
+
+	{9, "notifications", exec(`
+		-- A parent follows either all chores of a child or one chore
+		CREATE TABLE IF NOT EXISTS notification_subscriptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			child_id INTEGER,
+			chore_id INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (child_id) REFERENCES users(id),
+			FOREIGN KEY (chore_id) REFERENCES chores(id),
+			CHECK ((child_id IS NULL) <> (chore_id IS NULL))
+		);
+
+		CREATE TABLE IF NOT EXISTS notification_settings (
+			user_id INTEGER PRIMARY KEY,
+			batch_minutes INTEGER NOT NULL DEFAULT 15,
+			quiet_start TEXT NOT NULL DEFAULT '', -- HH:MM, empty for no quiet hours
+			quiet_end TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS notification_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL, -- recipient
+			kind TEXT NOT NULL, -- chore_completed
+			actor_id INTEGER NOT NULL,
+			chore_id INTEGER NOT NULL,
+			daily_chore_id INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			sent_at INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (actor_id) REFERENCES users(id),
+			FOREIGN KEY (chore_id) REFERENCES chores(id),
+			FOREIGN KEY (daily_chore_id) REFERENCES daily_chores(id)
+		);
+
+		-- Ticking a chore off again does not notify twice
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_events_once
+			ON notification_events (user_id, kind, daily_chore_id);
+	`)},
+
+	{10, "scheduled jobs", exec(`
+		CREATE TABLE IF NOT EXISTS jobs (
+			name TEXT PRIMARY KEY,
+			last_run_at INTEGER NOT NULL, -- the scheduled time of the last run
+			last_finished_at INTEGER,
+			last_error TEXT
+		);
+	`)},
+
+	// Archived users and chores keep their history but are hidden and no
+	// longer assigned
+	{11, "archiving", all(
+		addColumn("users", "archived_at", "INTEGER"),
+		addColumn("chores", "archived_at", "INTEGER"),
+	)},
+
+	{12, "api tokens", exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL, -- the user the token acts as
+			name TEXT NOT NULL,
+			hash TEXT UNIQUE NOT NULL, -- SHA-256 of the token, never the token itself
+			scope TEXT NOT NULL, -- read, complete or full
+			created_at INTEGER NOT NULL,
+			last_used_at INTEGER,
+			revoked_at INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		);
+	`)},
+
+	{13, "dynamic dns status", exec(`
+		CREATE TABLE IF NOT EXISTS dyndns_status (
+			domain TEXT PRIMARY KEY,
+			provider TEXT NOT NULL,
+			ip TEXT, -- the address the record was last set to
+			checked_at INTEGER NOT NULL,
+			updated_at INTEGER, -- when the record was last set
+			last_error TEXT,
+			failures INTEGER NOT NULL DEFAULT 0 -- failed updates in a row
+		);
+	`)},
+
+	// Weeks whose allowance has been credited, also those in which nobody
+	// earned any, so that missed weeks can be told apart
+	{14, "allowance weeks", exec(`
+		CREATE TABLE IF NOT EXISTS allowance_weeks (
+			week_start DATE PRIMARY KEY,
+			credited_at INTEGER NOT NULL
+		);
+
+		INSERT OR IGNORE INTO allowance_weeks (week_start, credited_at)
+		SELECT week_start, MIN(created_at) FROM allowance_transactions
+		WHERE kind = 'earned' AND week_start IS NOT NULL
+		GROUP BY week_start;
+	`)},
+
+	// The last points transaction a week's allowance was credited with, so
+	// that points approved later are paid with the next week
+	{15, "allowance week ledger position", all(
+		addColumn("allowance_weeks", "last_transaction_id", "INTEGER NOT NULL DEFAULT 0"),
+		exec(`
+			UPDATE allowance_weeks SET last_transaction_id = (
+				SELECT IFNULL(MAX(id), 0) FROM points_transactions
+				WHERE created_at <= allowance_weeks.credited_at
+			);
+		`),
+	)},
+}
+
+// Run applies all migrations the database is missing, each in its own
+// transaction, and returns the resulting schema version
+func Run(db *sql.DB) (int, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("error creating schema_version table: %v", err)
+	}
+
+	current, err := Version(db)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range All {
+		if m.Version <= current {
+			continue
+		}
+		if err := apply(db, m); err != nil {
+			return current, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %d (%s)", m.Version, m.Name)
+		current = m.Version
+	}
+	return current, nil
+}
+
+// Version returns the schema version of the database, 0 for a new database
+func Version(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT IFNULL(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %v", err)
+	}
+	return version, nil
+}
+
+func apply(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// exec returns a migration step running the given SQL
+func exec(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// all returns a migration step running the given steps in order
+func all(steps ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn returns a migration step adding a column unless it exists
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := addColumnIfMissing(tx, table, column, definition)
+		return err
+	}
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is
+// already there, and reports whether it was added
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err == nil, err
+}
@@ -0,0 +1,176 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "chores.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schema returns the SQL of every table and index, in a stable order
+func schema(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	rows, err := db.Query("SELECT IFNULL(sql, '') FROM sqlite_master ORDER BY type, name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var statements []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		statements = append(statements, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(statements, ";\n")
+}
+
+func TestMigrationVersionsAscend(t *testing.T) {
+	for i, m := range All {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+	}
+}
+
+func TestRunIsIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	latest := All[len(All)-1].Version
+
+	version, err := Run(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latest {
+		t.Fatalf("Run = %d, want %d", version, latest)
+	}
+	before := schema(t, db)
+
+	for run := 2; run <= 3; run++ {
+		version, err := Run(db)
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if version != latest {
+			t.Errorf("run %d = %d, want %d", run, version, latest)
+		}
+	}
+	if after := schema(t, db); after != before {
+		t.Errorf("schema changed by running again:\n%s\nwant:\n%s", after, before)
+	}
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(All) {
+		t.Errorf("%d migrations recorded, want %d", applied, len(All))
+	}
+}
+
+// Every migration has to work on a database that already has its changes,
+// as created by versions of the server from before the migrations
+func TestMigrationsReapply(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := Run(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range All {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Up(tx); err != nil {
+			t.Errorf("migration %d (%s) failed on a migrated database: %v", m.Version, m.Name, err)
+		}
+		tx.Rollback()
+	}
+}
+
+func TestRunUpgradesLegacyDatabase(t *testing.T) {
+	db := openTestDB(t)
+	// The tables as the server created them before the migrations
+	_, err := db.Exec(`
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			hash TEXT NOT NULL,
+			email TEXT NOT NULL,
+			role TEXT NOT NULL,
+			points INTEGER DEFAULT 0
+		);
+		CREATE TABLE chores (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			points INTEGER NOT NULL,
+			default_user_id INTEGER
+		);
+		CREATE TABLE daily_chores (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			chore_id INTEGER NOT NULL,
+			date DATE NOT NULL,
+			completed BOOLEAN DEFAULT FALSE
+		);
+
+		INSERT INTO users (username, hash, email, role, points) VALUES ('kid', '', 'kid@example.com', 'child', 7);
+		INSERT INTO chores (name, points, default_user_id) VALUES ('dishes', 5, 1);
+		INSERT INTO daily_chores (user_id, chore_id, date, completed) VALUES
+			(1, 1, '2024-05-01', FALSE),
+			(1, 1, '2024-05-01', TRUE),
+			(1, 1, '2024-05-02', FALSE);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 1; run <= 2; run++ {
+		if _, err := Run(db); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+
+	var balance int
+	if err := db.QueryRow("SELECT SUM(amount) FROM points_transactions WHERE user_id = 1").Scan(&balance); err != nil {
+		t.Fatal(err)
+	}
+	if balance != 7 {
+		t.Errorf("balance %d after upgrading, want the 7 points kept in users.points", balance)
+	}
+
+	rows, err := db.Query("SELECT id, status FROM daily_chores ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var id int
+		var status string
+		if err := rows.Scan(&id, &status); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d:%s", id, status))
+	}
+	if want := "2:approved 3:open"; strings.Join(got, " ") != want {
+		t.Errorf("daily chores %q after upgrading, want %q", strings.Join(got, " "), want)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
         "database/sql"
+	"errors"
 	"fmt"
         "time"
 
@@ -14,23 +15,32 @@ type User struct {
         hash string
         Email    string
         Role     string
-        Points   int
+        Points   int // current balance, derived from the points ledger
+        Archived bool
 }
 
 type Chore struct {
-        ID     int
-        Name   string
-        Points int
+        ID            int
+        Name          string
+        Points        int
+        DefaultUserID int // 0 if the chore has to be claimed
+        Recurrence    Recurrence
+        Archived      bool
 }
 
 type DailyChore struct {
-        ID        int
-        UserID    int
-        ChoreID   int
-        Date      time.Time
-        Completed bool
+        ID         int
+        UserID     int
+        ChoreID    int
+        Date       string // 2006-01-02
+        Completed  bool
+        Status     string
+        ReviewNote string
 }
 
+// errInUse is returned when deleting a record that other records refer to
+var errInUse = errors.New("still referenced by other records")
+
 // HashPassword hashes a password using bcrypt
 func HashPassword(password string) (string, error) {
         bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
@@ -45,9 +55,9 @@ func CheckPasswordHash(password, hash string) bool {
 
 // GetUserByUsername retrieves a user by their username
 func GetUserByUsername(db *sql.DB, username string) (*User, error) {
-        row := db.QueryRow("SELECT id, username, hash, email, role, points FROM users WHERE username = ?", username)
+        row := db.QueryRow("SELECT id, username, hash, email, role, "+userBalanceSQL+", archived_at IS NOT NULL FROM users WHERE username = ?", username)
         var user User
-        err := row.Scan(&user.ID, &user.Username, &user.hash, &user.Email, &user.Role, &user.Points)
+        err := row.Scan(&user.ID, &user.Username, &user.hash, &user.Email, &user.Role, &user.Points, &user.Archived)
         if err != nil {
                 return nil, err
         }
@@ -66,11 +76,70 @@ func CreateUser(db *sql.DB, username, password, email, role string) error {
 }
 
 // CreateChore adds a new chore to the database, including a default user
-func CreateChore(db *sql.DB, name string, points int, defaultUserID int) error {
-    _, err := db.Exec("INSERT INTO chores (name, points, default_user_id) VALUES (?, ?, ?)", name, points, defaultUserID)
+// (0 for none) and the recurrence rule deciding on which days it is due
+func CreateChore(db *sql.DB, name string, points int, defaultUserID int, recurrence Recurrence) error {
+    var defaultUser sql.NullInt64
+    if defaultUserID != 0 {
+        defaultUser = nullID(defaultUserID)
+    }
+    _, err := db.Exec("INSERT INTO chores (name, points, default_user_id, recurrence) VALUES (?, ?, ?, ?)", name, points, defaultUser, recurrence.String())
     return err
 }
 
+// AssignDueChores assigns every chore due on the given date to its default
+// user, skipping chores that already have an assignment for that date and
+// archived chores and users
+func AssignDueChores(db *sql.DB, date time.Time) error {
+    rows, err := db.Query(`
+        SELECT c.id, c.default_user_id, c.recurrence
+        FROM chores c
+        JOIN users u ON c.default_user_id = u.id
+        WHERE c.archived_at IS NULL AND u.archived_at IS NULL
+    `)
+    if err != nil {
+        return fmt.Errorf("error getting chores: %v", err)
+    }
+
+    type dueChore struct {
+        choreID int
+        userID  int
+    }
+    var due []dueChore
+    for rows.Next() {
+        var c dueChore
+        var recurrence string
+        if err := rows.Scan(&c.choreID, &c.userID, &recurrence); err != nil {
+            rows.Close()
+            return fmt.Errorf("error scanning chore: %v", err)
+        }
+        rec, err := ParseRecurrence(recurrence)
+        if err != nil {
+            rows.Close()
+            return fmt.Errorf("chore %d: %v", c.choreID, err)
+        }
+        if rec.OccursOn(date) {
+            due = append(due, c)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return fmt.Errorf("error getting chores: %v", err)
+    }
+
+    day := date.Format("2006-01-02")
+    for _, c := range due {
+        // The unique (chore_id, date) index makes this safe to run concurrently
+        _, err := db.Exec(`
+            INSERT OR IGNORE INTO daily_chores (user_id, chore_id, date)
+            VALUES (?, ?, ?)
+        `, c.userID, c.choreID, day)
+        if err != nil {
+            return fmt.Errorf("error assigning chore %d: %v", c.choreID, err)
+        }
+    }
+    return nil
+}
+
 // AssignChoreToUser assigns a chore to a user for a given date
 func AssignChoreToUser(db *sql.DB, userID, choreID int, date string) error {
         _, err := db.Exec("INSERT INTO daily_chores (user_id, chore_id, date) VALUES (?, ?, ?)", userID, choreID, date)
@@ -80,14 +149,8 @@ func AssignChoreToUser(db *sql.DB, userID, choreID int, date string) error {
 func GetDailyPoints(db *sql.DB, userID int, days int) (map[string]int, error) {
     dailyPoints := make(map[string]int)
     for i := 0; i < days; i++ {
-        date := time.Now().AddDate(0, 0, -i).Format("2006-01-02")
-        var points int
-        err := db.QueryRow(`
-            SELECT IFNULL(SUM(c.points), 0)
-            FROM daily_chores dc
-            JOIN chores c ON dc.chore_id = c.id
-            WHERE dc.user_id = ? AND dc.date = ? AND dc.completed = TRUE
-        `, userID, date).Scan(&points)
+        date := householdNow().AddDate(0, 0, -i).Format("2006-01-02")
+        points, err := pointsEarnedBetween(db, userID, date, date)
         if err != nil {
             return nil, fmt.Errorf("error getting daily points: %v", err)
         }
@@ -99,15 +162,9 @@ func GetDailyPoints(db *sql.DB, userID int, days int) (map[string]int, error) {
 func GetWeeklyPoints(db *sql.DB, userID int, weeks int) (map[string]int, error) {
     weeklyPoints := make(map[string]int)
     for i := 0; i < weeks; i++ {
-        startDate := time.Now().AddDate(0, 0, -i*7 - 6).Format("2006-01-02")
-        endDate := time.Now().AddDate(0, 0, -i*7).Format("2006-01-02")
-        var points int
-        err := db.QueryRow(`
-            SELECT IFNULL(SUM(c.points), 0)
-            FROM daily_chores dc
-            JOIN chores c ON dc.chore_id = c.id
-            WHERE dc.user_id = ? AND dc.date BETWEEN ? AND ? AND dc.completed = TRUE
-        `, userID, startDate, endDate).Scan(&points)
+        startDate := householdNow().AddDate(0, 0, -i*7 - 6).Format("2006-01-02")
+        endDate := householdNow().AddDate(0, 0, -i*7).Format("2006-01-02")
+        points, err := pointsEarnedBetween(db, userID, startDate, endDate)
         if err != nil {
             return nil, fmt.Errorf("error getting weekly points: %v", err)
         }
@@ -115,3 +172,344 @@ func GetWeeklyPoints(db *sql.DB, userID int, weeks int) (map[string]int, error)
     }
     return weeklyPoints, nil
 }
+
+// GetUsers returns all users including archived ones, ordered by username
+func GetUsers(db *sql.DB) ([]User, error) {
+	rows, err := db.Query("SELECT id, username, hash, email, role, " + userBalanceSQL + ", archived_at IS NOT NULL FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.hash, &user.Email, &user.Role, &user.Points, &user.Archived); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// UpdateUser saves the user's username, email and role, and a new password
+// unless password is empty
+func UpdateUser(db *sql.DB, user *User, password string) error {
+	if password != "" {
+		hash, err := HashPassword(password)
+		if err != nil {
+			return err
+		}
+		user.hash = hash
+	}
+	_, err := db.Exec("UPDATE users SET username = ?, hash = ?, email = ?, role = ? WHERE id = ?",
+		user.Username, user.hash, user.Email, user.Role, user.ID)
+	return err
+}
+
+// DeleteUser deletes a user that has no chores, points or allowance yet.
+// Users with a history can't be deleted.
+func DeleteUser(db *sql.DB, id int) error {
+	var refs int
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM daily_chores WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM points_transactions WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM allowance_transactions WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM reward_redemptions WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM chores WHERE default_user_id = ?)
+	`, id, id, id, id, id).Scan(&refs)
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		return errInUse
+	}
+	return deleteRow(db, "DELETE FROM users WHERE id = ?", id, func(tx *sql.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM sessions WHERE user_id = ?",
+			"DELETE FROM api_tokens WHERE user_id = ?",
+			"DELETE FROM allowance_settings WHERE user_id = ?",
+			"DELETE FROM notification_settings WHERE user_id = ?",
+			"DELETE FROM notification_subscriptions WHERE user_id = ?",
+			"DELETE FROM notification_subscriptions WHERE child_id = ?",
+			"DELETE FROM notification_events WHERE user_id = ?",
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ArchiveUser hides a user and stops assigning chores to them while keeping
+// their history. They are logged out and their open chores from today on
+// are removed.
+func ArchiveUser(db *sql.DB, id int) error {
+	return archive(db, "users", id, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+			return err
+		}
+		return deleteOpenDailyChores(tx, "user_id", id)
+	})
+}
+
+// RestoreUser undoes ArchiveUser
+func RestoreUser(db *sql.DB, id int) error {
+	return restore(db, "users", id)
+}
+
+// RemoveUser deletes a user, or archives them if they have a history.
+// It reports whether the user was archived.
+func RemoveUser(db *sql.DB, id int) (bool, error) {
+	err := DeleteUser(db, id)
+	if err == errInUse {
+		return true, ArchiveUser(db, id)
+	}
+	return false, err
+}
+
+// GetChores returns all chores including archived ones, ordered by name
+func GetChores(db *sql.DB) ([]Chore, error) {
+	rows, err := db.Query("SELECT id, name, points, IFNULL(default_user_id, 0), recurrence, archived_at IS NOT NULL FROM chores ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chores := []Chore{}
+	for rows.Next() {
+		chore, err := scanChore(rows)
+		if err != nil {
+			return nil, err
+		}
+		chores = append(chores, *chore)
+	}
+	return chores, rows.Err()
+}
+
+// GetChore returns the chore with the given ID
+func GetChore(db *sql.DB, id int) (*Chore, error) {
+	row := db.QueryRow("SELECT id, name, points, IFNULL(default_user_id, 0), recurrence, archived_at IS NOT NULL FROM chores WHERE id = ?", id)
+	return scanChore(row)
+}
+
+func scanChore(row interface{ Scan(...interface{}) error }) (*Chore, error) {
+	var chore Chore
+	var recurrence string
+	if err := row.Scan(&chore.ID, &chore.Name, &chore.Points, &chore.DefaultUserID, &recurrence, &chore.Archived); err != nil {
+		return nil, err
+	}
+	rec, err := ParseRecurrence(recurrence)
+	if err != nil {
+		return nil, fmt.Errorf("chore %d: %v", chore.ID, err)
+	}
+	chore.Recurrence = rec
+	return &chore, nil
+}
+
+// UpdateChore saves a chore's name, points, default user and recurrence.
+// Points already credited for the chore stay as they are.
+func UpdateChore(db *sql.DB, chore Chore) error {
+	var defaultUserID sql.NullInt64
+	if chore.DefaultUserID != 0 {
+		defaultUserID = nullID(chore.DefaultUserID)
+	}
+	_, err := db.Exec("UPDATE chores SET name = ?, points = ?, default_user_id = ?, recurrence = ? WHERE id = ?",
+		chore.Name, chore.Points, defaultUserID, chore.Recurrence.String(), chore.ID)
+	return err
+}
+
+// DeleteChore deletes a chore that has never been assigned
+func DeleteChore(db *sql.DB, id int) error {
+	var refs int
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM daily_chores WHERE chore_id = ?)
+			+ (SELECT COUNT(*) FROM points_transactions WHERE chore_id = ?)
+	`, id, id).Scan(&refs)
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		return errInUse
+	}
+	return deleteRow(db, "DELETE FROM chores WHERE id = ?", id, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM notification_subscriptions WHERE chore_id = ?", id)
+		return err
+	})
+}
+
+// ArchiveChore hides a chore and stops assigning it while keeping its
+// history. Its open assignments from today on are removed.
+func ArchiveChore(db *sql.DB, id int) error {
+	return archive(db, "chores", id, func(tx *sql.Tx) error {
+		return deleteOpenDailyChores(tx, "chore_id", id)
+	})
+}
+
+// RestoreChore undoes ArchiveChore
+func RestoreChore(db *sql.DB, id int) error {
+	return restore(db, "chores", id)
+}
+
+// RemoveChore deletes a chore, or archives it if it has been assigned
+// before. It reports whether the chore was archived.
+func RemoveChore(db *sql.DB, id int) (bool, error) {
+	err := DeleteChore(db, id)
+	if err == errInUse {
+		return true, ArchiveChore(db, id)
+	}
+	return false, err
+}
+
+// archive sets archived_at on a row of table unless it is already archived
+// and runs cleanup in the same transaction. It returns sql.ErrNoRows if
+// there is no such row.
+func archive(db *sql.DB, table string, id int, cleanup func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var archived bool
+	err = tx.QueryRow("SELECT archived_at IS NOT NULL FROM "+table+" WHERE id = ?", id).Scan(&archived)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE "+table+" SET archived_at = ? WHERE id = ?", time.Now().Unix(), id); err != nil {
+		return err
+	}
+	if err := cleanup(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// restore clears archived_at on a row of table
+func restore(db *sql.DB, table string, id int) error {
+	result, err := db.Exec("UPDATE "+table+" SET archived_at = NULL WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+// deleteOpenDailyChores removes the open and rejected daily chores from
+// today on whose column equals id
+func deleteOpenDailyChores(tx *sql.Tx, column string, id int) error {
+	open := "SELECT id FROM daily_chores WHERE " + column + " = ? AND date >= ? AND status IN (?, ?)"
+	today := householdToday()
+	_, err := tx.Exec("DELETE FROM notification_events WHERE daily_chore_id IN ("+open+")", id, today, StatusOpen, StatusRejected)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM daily_chores WHERE id IN ("+open+")", id, today, StatusOpen, StatusRejected)
+	return err
+}
+
+// GetDailyChores returns the daily chores on the given date, or on all
+// dates if date is empty, of the given user, or of all users if userID is 0
+func GetDailyChores(db *sql.DB, userID int, date string) ([]DailyChore, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, chore_id, date, completed, status, IFNULL(review_note, '')
+		FROM daily_chores
+		WHERE (? = 0 OR user_id = ?) AND (? = '' OR date = ?)
+		ORDER BY date DESC, id
+	`, userID, userID, date, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dailyChores := []DailyChore{}
+	for rows.Next() {
+		dc, err := scanDailyChore(rows)
+		if err != nil {
+			return nil, err
+		}
+		dailyChores = append(dailyChores, *dc)
+	}
+	return dailyChores, rows.Err()
+}
+
+// GetDailyChore returns the daily chore with the given ID
+func GetDailyChore(db *sql.DB, id int) (*DailyChore, error) {
+	row := db.QueryRow(`
+		SELECT id, user_id, chore_id, date, completed, status, IFNULL(review_note, '')
+		FROM daily_chores
+		WHERE id = ?
+	`, id)
+	return scanDailyChore(row)
+}
+
+func scanDailyChore(row interface{ Scan(...interface{}) error }) (*DailyChore, error) {
+	var dc DailyChore
+	var date time.Time
+	if err := row.Scan(&dc.ID, &dc.UserID, &dc.ChoreID, &date, &dc.Completed, &dc.Status, &dc.ReviewNote); err != nil {
+		return nil, err
+	}
+	dc.Date = date.Format("2006-01-02")
+	return &dc, nil
+}
+
+// ReassignDailyChore moves a daily chore to another user or date. Chores
+// that have been completed keep their assignment.
+func ReassignDailyChore(db *sql.DB, id, userID int, date string) error {
+	result, err := db.Exec(`
+		UPDATE daily_chores SET user_id = ?, date = ? WHERE id = ? AND status IN (?, ?)
+	`, userID, date, id, StatusOpen, StatusRejected)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return errChoreAlreadyCompleted
+	}
+	return nil
+}
+
+// DeleteDailyChore deletes a daily chore that hasn't been completed
+func DeleteDailyChore(db *sql.DB, id int) error {
+	var status string
+	if err := db.QueryRow("SELECT status FROM daily_chores WHERE id = ?", id).Scan(&status); err != nil {
+		return err
+	}
+	if status != StatusOpen && status != StatusRejected {
+		return errChoreAlreadyCompleted
+	}
+	return deleteRow(db, "DELETE FROM daily_chores WHERE id = ?", id, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM notification_events WHERE daily_chore_id = ?", id)
+		return err
+	})
+}
+
+// deleteRow runs cleanup and then the delete query in one transaction. It
+// returns sql.ErrNoRows if there was nothing to delete.
+func deleteRow(db *sql.DB, query string, id int, cleanup func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := cleanup(tx); err != nil {
+		return err
+	}
+	result, err := tx.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
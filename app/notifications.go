@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of notification events
+const (
+	EventChoreCompleted = "chore_completed"
+)
+
+// NotificationSettings controls when a parent's notifications are sent.
+// Events are collected for BatchMinutes after the first one and then sent
+// together, unless it is quiet time.
+type NotificationSettings struct {
+	UserID       int
+	BatchMinutes int
+	QuietStart   string // HH:MM, empty for no quiet hours
+	QuietEnd     string
+}
+
+// Subscription follows all chores of a child (ChildID) or one chore (ChoreID)
+type Subscription struct {
+	ChildID int
+	ChoreID int
+}
+
+// ChoreEvent is a completed chore a parent is notified about
+type ChoreEvent struct {
+	ID        int
+	ChildName string
+	ChoreName string
+	Date      string
+	CreatedAt time.Time
+}
+
+const notificationInterval = time.Minute
+
+// GetNotificationSettings returns the user's notification settings, or the
+// defaults if they have not saved any
+func GetNotificationSettings(db *sql.DB, userID int) (NotificationSettings, error) {
+	s := NotificationSettings{UserID: userID, BatchMinutes: 15}
+	err := db.QueryRow(`
+		SELECT batch_minutes, quiet_start, quiet_end FROM notification_settings WHERE user_id = ?
+	`, userID).Scan(&s.BatchMinutes, &s.QuietStart, &s.QuietEnd)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	return s, err
+}
+
+// SaveNotificationSettings stores the user's notification settings
+func SaveNotificationSettings(db *sql.DB, s NotificationSettings) error {
+	_, err := db.Exec(`
+		INSERT INTO notification_settings (user_id, batch_minutes, quiet_start, quiet_end)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			batch_minutes = excluded.batch_minutes,
+			quiet_start = excluded.quiet_start,
+			quiet_end = excluded.quiet_end
+	`, s.UserID, s.BatchMinutes, s.QuietStart, s.QuietEnd)
+	return err
+}
+
+// GetSubscriptions returns what the user is subscribed to
+func GetSubscriptions(db *sql.DB, userID int) ([]Subscription, error) {
+	rows, err := db.Query(`
+		SELECT IFNULL(child_id, 0), IFNULL(chore_id, 0) FROM notification_subscriptions WHERE user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var sub Subscription
+		if err := rows.Scan(&sub.ChildID, &sub.ChoreID); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// SaveSubscriptions replaces the user's subscriptions
+func SaveSubscriptions(db *sql.DB, userID int, subs []Subscription) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM notification_subscriptions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		var childID, choreID sql.NullInt64
+		if sub.ChildID != 0 {
+			childID = nullID(sub.ChildID)
+		} else {
+			choreID = nullID(sub.ChoreID)
+		}
+		_, err := tx.Exec(`
+			INSERT INTO notification_subscriptions (user_id, child_id, chore_id) VALUES (?, ?, ?)
+		`, userID, childID, choreID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// QueueChoreCompleted records a chore completed event for every parent
+// subscribed to the user or the chore. The events are sent later by
+// deliverNotifications.
+func QueueChoreCompleted(db *sql.DB, user *User, choreID int, date string) error {
+	_, err := db.Exec(`
+		INSERT OR IGNORE INTO notification_events (user_id, kind, actor_id, chore_id, daily_chore_id, created_at)
+		SELECT DISTINCT s.user_id, ?, dc.user_id, dc.chore_id, dc.id, ?
+		FROM daily_chores dc
+		JOIN notification_subscriptions s ON s.child_id = dc.user_id OR s.chore_id = dc.chore_id
+		JOIN users p ON s.user_id = p.id AND p.archived_at IS NULL
+		WHERE dc.user_id = ? AND dc.chore_id = ? AND dc.date = ? AND s.user_id <> dc.user_id
+	`, EventChoreCompleted, time.Now().Unix(), user.ID, choreID, date)
+	return err
+}
+
+// scheduleNotifications sends queued notifications every minute until ctx
+// is cancelled
+func scheduleNotifications(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(notificationInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		// Quiet hours are in the household's timezone
+		if err := deliverNotifications(db, now.In(config.Location())); err != nil {
+			log.Printf("Error delivering notifications: %v", err)
+		}
+	}
+}
+
+// deliverNotifications sends each parent one message with their queued
+// events once the batch window has passed and it is not quiet time
+func deliverNotifications(db *sql.DB, now time.Time) error {
+	rows, err := db.Query(`
+		SELECT user_id, MIN(created_at), MAX(id)
+		FROM notification_events
+		WHERE sent_at IS NULL
+		GROUP BY user_id
+	`)
+	if err != nil {
+		return err
+	}
+	type batch struct {
+		userID int
+		oldest time.Time
+		lastID int
+	}
+	var batches []batch
+	for rows.Next() {
+		var b batch
+		var oldest int64
+		if err := rows.Scan(&b.userID, &oldest, &b.lastID); err != nil {
+			rows.Close()
+			return err
+		}
+		b.oldest = time.Unix(oldest, 0)
+		batches = append(batches, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, b := range batches {
+		settings, err := GetNotificationSettings(db, b.userID)
+		if err != nil {
+			return err
+		}
+		if now.Sub(b.oldest) < time.Duration(settings.BatchMinutes)*time.Minute {
+			continue
+		}
+		if inQuietHours(settings.QuietStart, settings.QuietEnd, now) {
+			continue
+		}
+
+		events, err := getQueuedChoreEvents(db, b.userID, b.lastID)
+		if err != nil {
+			return err
+		}
+		if len(events) > 0 {
+			parent, err := GetUserByID(db, b.userID)
+			if err != nil {
+				return err
+			}
+			if err := sendChoreCompletionEmail(parent, events); err != nil {
+				// Keep the events queued and try again on the next run
+				log.Printf("Error notifying %s: %v", parent.Username, err)
+				continue
+			}
+		}
+
+		_, err = db.Exec(`
+			UPDATE notification_events SET sent_at = ? WHERE user_id = ? AND id <= ? AND sent_at IS NULL
+		`, now.Unix(), b.userID, b.lastID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getQueuedChoreEvents returns the user's unsent chore completed events up
+// to lastID. Chores that were unticked or rejected in the meantime are left out.
+func getQueuedChoreEvents(db *sql.DB, userID, lastID int) ([]ChoreEvent, error) {
+	rows, err := db.Query(`
+		SELECT e.id, u.username, c.name, dc.date, e.created_at
+		FROM notification_events e
+		JOIN users u ON e.actor_id = u.id
+		JOIN chores c ON e.chore_id = c.id
+		JOIN daily_chores dc ON e.daily_chore_id = dc.id
+		WHERE e.user_id = ? AND e.id <= ? AND e.sent_at IS NULL AND e.kind = ?
+			AND dc.status IN (?, ?)
+		ORDER BY e.id
+	`, userID, lastID, EventChoreCompleted, StatusPending, StatusApproved)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []ChoreEvent
+	for rows.Next() {
+		var e ChoreEvent
+		var date time.Time
+		var createdAt int64
+		if err := rows.Scan(&e.ID, &e.ChildName, &e.ChoreName, &date, &createdAt); err != nil {
+			return nil, err
+		}
+		e.Date = date.Format("2006-01-02")
+		e.CreatedAt = time.Unix(createdAt, 0).In(config.Location())
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// inQuietHours reports whether t falls between start and end (HH:MM). The
+// quiet hours may wrap around midnight, e.g. 21:00 to 07:00.
+func inQuietHours(start, end string, t time.Time) bool {
+	from, err := parseClock(start)
+	if err != nil {
+		return false
+	}
+	to, err := parseClock(end)
+	if err != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// parseClock parses a time of day such as "21:30" into minutes after midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// getChoreNames returns the IDs and names of all chores that aren't
+// archived, ordered by name
+func getChoreNames(db *sql.DB) ([]Chore, error) {
+	rows, err := db.Query("SELECT id, name FROM chores WHERE archived_at IS NULL ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chores []Chore
+	for rows.Next() {
+		var chore Chore
+		if err := rows.Scan(&chore.ID, &chore.Name); err != nil {
+			return nil, err
+		}
+		chores = append(chores, chore)
+	}
+	return chores, rows.Err()
+}
+
+// notificationsHandler shows a parent's notification settings
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	settings, err := GetNotificationSettings(db, user.ID)
+	if err != nil {
+		log.Printf("Error fetching notification settings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	subs, err := GetSubscriptions(db, user.ID)
+	if err != nil {
+		log.Printf("Error fetching subscriptions: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	children, err := getChildren(db)
+	if err != nil {
+		log.Printf("Error fetching children: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chores, err := getChoreNames(db)
+	if err != nil {
+		log.Printf("Error fetching chores: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type option struct {
+		ID         int
+		Name       string
+		Subscribed bool
+	}
+	data := struct {
+		Settings NotificationSettings
+		Children []option
+		Chores   []option
+	}{Settings: settings}
+	for _, child := range children {
+		opt := option{ID: child.ID, Name: child.Username}
+		for _, sub := range subs {
+			opt.Subscribed = opt.Subscribed || sub.ChildID == child.ID
+		}
+		data.Children = append(data.Children, opt)
+	}
+	for _, chore := range chores {
+		opt := option{ID: chore.ID, Name: chore.Name}
+		for _, sub := range subs {
+			opt.Subscribed = opt.Subscribed || sub.ChoreID == chore.ID
+		}
+		data.Chores = append(data.Chores, opt)
+	}
+	templates.ExecuteTemplate(w, "notifications.html", data)
+}
+
+// notificationSettingsHandler saves a parent's subscriptions and settings
+func notificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	batchMinutes, err := strconv.Atoi(r.FormValue("batch_minutes"))
+	if err != nil || batchMinutes < 0 {
+		http.Error(w, "Invalid batch minutes", http.StatusBadRequest)
+		return
+	}
+	settings := NotificationSettings{
+		UserID:       user.ID,
+		BatchMinutes: batchMinutes,
+		QuietStart:   strings.TrimSpace(r.FormValue("quiet_start")),
+		QuietEnd:     strings.TrimSpace(r.FormValue("quiet_end")),
+	}
+	if (settings.QuietStart == "") != (settings.QuietEnd == "") {
+		http.Error(w, "Set both the start and the end of the quiet hours", http.StatusBadRequest)
+		return
+	}
+	for _, clock := range []string{settings.QuietStart, settings.QuietEnd} {
+		if _, err := parseClock(clock); clock != "" && err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var subs []Subscription
+	for _, idStr := range r.Form["child_id"] {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid child ID", http.StatusBadRequest)
+			return
+		}
+		subs = append(subs, Subscription{ChildID: id})
+	}
+	for _, idStr := range r.Form["chore_id"] {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid chore ID", http.StatusBadRequest)
+			return
+		}
+		subs = append(subs, Subscription{ChoreID: id})
+	}
+
+	if err := SaveNotificationSettings(db, settings); err != nil {
+		log.Printf("Error saving notification settings: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := SaveSubscriptions(db, user.ID, subs); err != nil {
+		log.Printf("Error saving subscriptions: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
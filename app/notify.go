@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages to users. The server uses a single notifier,
+// chosen by the notifier setting in the config.
+type Notifier interface {
+	Notify(msg Message) error
+}
+
+// Message is a notification. Body is plain text; HTML is an optional
+// alternative for clients that can show it.
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+	HTML    string
+}
+
+// Notifier kinds for Config.Notifier
+const (
+	NotifierSMTP = "smtp"
+	NotifierLog  = "log"
+)
+
+// SMTP connection security modes for SMTPConfig.TLS
+const (
+	SMTPStartTLS = "starttls" // plain connection upgraded with STARTTLS
+	SMTPTLS      = "tls"      // implicit TLS, usually on port 465
+	SMTPNone     = "none"     // no encryption, for local mail catchers
+)
+
+var notifier Notifier
+
+// NewNotifier returns the notifier selected in the config
+func NewNotifier(cfg Config) (Notifier, error) {
+	switch cfg.Notifier {
+	case NotifierSMTP:
+		return &SMTPNotifier{cfg: cfg.SMTP}, nil
+	case NotifierLog:
+		if cfg.NotifierFile == "" {
+			return &LogNotifier{w: log.Writer()}, nil
+		}
+		f, err := os.OpenFile(cfg.NotifierFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening notifier file: %v", err)
+		}
+		return &LogNotifier{w: f}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", cfg.Notifier)
+}
+
+// SMTPNotifier sends messages as email
+type SMTPNotifier struct {
+	cfg SMTPConfig
+}
+
+const smtpTimeout = 30 * time.Second
+
+// Notify sends the message to all its recipients in one SMTP session
+func (n *SMTPNotifier) Notify(msg Message) error {
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: n.cfg.Host}
+
+	var conn net.Conn
+	var err error
+	if n.cfg.TLS == SMTPTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, smtpTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if n.cfg.TLS == SMTPStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("error starting TLS: %v", err)
+		}
+	}
+	if n.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return fmt.Errorf("error authenticating: %v", err)
+		}
+	}
+
+	if err := c.Mail(n.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("error adding recipient %s: %v", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatEmail(n.cfg.From, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// formatEmail builds the MIME email for a message: a plain text email, or
+// a multipart/alternative one with text and HTML parts if the message has HTML
+func formatEmail(from string, msg Message) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + strings.Join(msg.To, ", ") + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Message-ID: " + messageID(from) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&b, msg.Body)
+		return b.Bytes()
+	}
+
+	mw := multipart.NewWriter(&b)
+	b.WriteString("Content-Type: multipart/alternative; boundary=" + mw.Boundary() + "\r\n\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain", msg.Body},
+		{"text/html", msg.HTML},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType+"; charset=UTF-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, _ := mw.CreatePart(header) // only fails if writing to b fails
+		writeQuotedPrintable(w, part.content)
+	}
+	mw.Close()
+	return b.Bytes()
+}
+
+// writeQuotedPrintable writes content with CRLF line endings, quoted-printable
+// encoded
+func writeQuotedPrintable(w io.Writer, content string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(strings.ReplaceAll(content, "\n", "\r\n")))
+	qp.Close()
+}
+
+// messageID returns a unique Message-ID in the sender's domain
+func messageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return fmt.Sprintf("<%x.%d@%s>", buf, time.Now().Unix(), domain)
+}
+
+// LogNotifier writes messages to the log or a file instead of sending them,
+// for development
+type LogNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Notify writes the message
+func (n *LogNotifier) Notify(msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := fmt.Fprintf(n.w, "--- notification %s\nTo: %s\nSubject: %s\n\n%s\n",
+		time.Now().Format(time.RFC3339), strings.Join(msg.To, ", "), msg.Subject, msg.Body)
+	return err
+}
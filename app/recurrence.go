@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence kinds supported for chores
+const (
+	RecurDaily    = "daily"
+	RecurWeekdays = "weekdays"
+	RecurWeekly   = "weekly"
+	RecurEvery    = "every"
+	RecurMonthly  = "monthly"
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Recurrence describes on which dates a chore is due. It is stored in the
+// chores.recurrence column using a compact text form, e.g. "daily",
+// "weekdays", "weekly:tue,fri", "every:14:2024-05-01" or "monthly:15".
+type Recurrence struct {
+	Kind     string
+	Days     []time.Weekday // weekly: days of the week the chore is due
+	Interval int            // every: number of days between occurrences
+	Start    time.Time      // every: date of the first occurrence
+	MonthDay int            // monthly: day of the month, clamped to the month's end
+}
+
+// ParseRecurrence parses the text form stored in the database
+func ParseRecurrence(s string) (Recurrence, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	rec := Recurrence{Kind: parts[0]}
+
+	switch rec.Kind {
+	case "", RecurDaily:
+		rec.Kind = RecurDaily
+	case RecurWeekdays:
+	case RecurWeekly:
+		if len(parts) != 2 {
+			return rec, fmt.Errorf("invalid weekly recurrence %q", s)
+		}
+		for _, name := range strings.Split(parts[1], ",") {
+			day, err := parseWeekday(name)
+			if err != nil {
+				return rec, err
+			}
+			rec.Days = append(rec.Days, day)
+		}
+	case RecurEvery:
+		if len(parts) != 3 {
+			return rec, fmt.Errorf("invalid interval recurrence %q", s)
+		}
+		interval, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return rec, fmt.Errorf("invalid interval in recurrence %q", s)
+		}
+		start, err := time.Parse("2006-01-02", parts[2])
+		if err != nil {
+			return rec, fmt.Errorf("invalid start date in recurrence %q", s)
+		}
+		rec.Interval = interval
+		rec.Start = start
+	case RecurMonthly:
+		if len(parts) != 2 {
+			return rec, fmt.Errorf("invalid monthly recurrence %q", s)
+		}
+		day, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return rec, fmt.Errorf("invalid day in recurrence %q", s)
+		}
+		rec.MonthDay = day
+	default:
+		return rec, fmt.Errorf("unknown recurrence %q", s)
+	}
+
+	return rec, rec.Validate()
+}
+
+// Validate checks that the recurrence has the fields its kind requires
+func (rec Recurrence) Validate() error {
+	switch rec.Kind {
+	case RecurDaily, RecurWeekdays:
+	case RecurWeekly:
+		if len(rec.Days) == 0 {
+			return fmt.Errorf("weekly recurrence needs at least one day")
+		}
+	case RecurEvery:
+		if rec.Interval < 1 {
+			return fmt.Errorf("recurrence interval must be at least 1 day")
+		}
+		if rec.Start.IsZero() {
+			return fmt.Errorf("interval recurrence needs a start date")
+		}
+	case RecurMonthly:
+		if rec.MonthDay < 1 || rec.MonthDay > 31 {
+			return fmt.Errorf("monthly recurrence day must be between 1 and 31")
+		}
+	default:
+		return fmt.Errorf("unknown recurrence %q", rec.Kind)
+	}
+	return nil
+}
+
+// String returns the text form stored in the database
+func (rec Recurrence) String() string {
+	switch rec.Kind {
+	case RecurWeekly:
+		names := make([]string, len(rec.Days))
+		for i, day := range rec.Days {
+			names[i] = weekdayNames[day]
+		}
+		return RecurWeekly + ":" + strings.Join(names, ",")
+	case RecurEvery:
+		return fmt.Sprintf("%s:%d:%s", RecurEvery, rec.Interval, rec.Start.Format("2006-01-02"))
+	case RecurMonthly:
+		return fmt.Sprintf("%s:%d", RecurMonthly, rec.MonthDay)
+	case "":
+		return RecurDaily
+	}
+	return rec.Kind
+}
+
+// HasDay reports whether a weekly recurrence includes the named day, for
+// filling in the chore form
+func (rec Recurrence) HasDay(name string) bool {
+	for _, day := range rec.Days {
+		if weekdayNames[day] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OccursOn reports whether a chore with this recurrence is due on the given date
+func (rec Recurrence) OccursOn(date time.Time) bool {
+	switch rec.Kind {
+	case RecurWeekdays:
+		return date.Weekday() != time.Saturday && date.Weekday() != time.Sunday
+	case RecurWeekly:
+		for _, day := range rec.Days {
+			if date.Weekday() == day {
+				return true
+			}
+		}
+		return false
+	case RecurEvery:
+		days := daysBetween(rec.Start, date)
+		return days >= 0 && days%rec.Interval == 0
+	case RecurMonthly:
+		day := rec.MonthDay
+		if last := daysInMonth(date); day > last {
+			day = last
+		}
+		return date.Day() == day
+	}
+	return true
+}
+
+// parseRecurrenceForm builds a recurrence from the fields of the chore form
+func parseRecurrenceForm(r *http.Request) (Recurrence, error) {
+	if err := r.ParseForm(); err != nil {
+		return Recurrence{}, err
+	}
+	rec := Recurrence{Kind: r.FormValue("recurrence")}
+	if rec.Kind == "" {
+		rec.Kind = RecurDaily
+	}
+
+	switch rec.Kind {
+	case RecurWeekly:
+		for _, name := range r.Form["recurrence_days"] {
+			day, err := parseWeekday(name)
+			if err != nil {
+				return rec, err
+			}
+			rec.Days = append(rec.Days, day)
+		}
+	case RecurEvery:
+		interval, err := strconv.Atoi(r.FormValue("recurrence_interval"))
+		if err != nil {
+			return rec, fmt.Errorf("invalid recurrence interval")
+		}
+		start, err := time.Parse("2006-01-02", r.FormValue("recurrence_start"))
+		if err != nil {
+			return rec, fmt.Errorf("invalid recurrence start date")
+		}
+		rec.Interval = interval
+		rec.Start = start
+	case RecurMonthly:
+		day, err := strconv.Atoi(r.FormValue("recurrence_month_day"))
+		if err != nil {
+			return rec, fmt.Errorf("invalid day of month")
+		}
+		rec.MonthDay = day
+	}
+
+	return rec, rec.Validate()
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range weekdayNames {
+		if len(name) >= 3 && n == name[:3] {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", name)
+}
+
+// daysBetween returns the number of calendar days from a to b
+func daysBetween(a, b time.Time) int {
+	start := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	end := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(end.Sub(start).Hours() / 24)
+}
+
+func daysInMonth(date time.Time) int {
+	return time.Date(date.Year(), date.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
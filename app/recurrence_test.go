@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // String of the result, empty if parsing fails
+	}{
+		{"", "daily"},
+		{"daily", "daily"},
+		{"weekdays", "weekdays"},
+		{"weekly:tue,fri", "weekly:tue,fri"},
+		{"weekly:Tuesday, FRI", "weekly:tue,fri"},
+		{"every:14:2024-05-01", "every:14:2024-05-01"},
+		{"monthly:15", "monthly:15"},
+		{"monthly:31", "monthly:31"},
+
+		{"weekly", ""},
+		{"weekly:", ""},
+		{"weekly:someday", ""},
+		{"every:3", ""},
+		{"every:0:2024-05-01", ""},
+		{"every:x:2024-05-01", ""},
+		{"every:3:2024-13-01", ""},
+		{"monthly:0", ""},
+		{"monthly:32", ""},
+		{"monthly:x", ""},
+		{"hourly", ""},
+	}
+	for _, tt := range tests {
+		rec, err := ParseRecurrence(tt.in)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("ParseRecurrence(%q) = %q, want an error", tt.in, rec)
+		case tt.want != "" && err != nil:
+			t.Errorf("ParseRecurrence(%q): %v", tt.in, err)
+		case tt.want != "" && rec.String() != tt.want:
+			t.Errorf("ParseRecurrence(%q) = %q, want %q", tt.in, rec, tt.want)
+		}
+	}
+}
+
+func TestRecurrenceOccursOn(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := func(s string) time.Time {
+		d, err := time.ParseInLocation("2006-01-02", s, newYork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		rec  string
+		date string
+		want bool
+	}{
+		{"daily", "2026-10-17", true},
+
+		{"weekdays", "2026-10-12", true}, // Monday
+		{"weekdays", "2026-10-16", true}, // Friday
+		{"weekdays", "2026-10-17", false},
+		{"weekdays", "2026-10-18", false},
+
+		{"weekly:tue,fri", "2026-10-13", true},
+		{"weekly:tue,fri", "2026-10-16", true},
+		{"weekly:tue,fri", "2026-10-14", false},
+
+		{"every:14:2026-10-01", "2026-10-01", true},
+		{"every:14:2026-10-01", "2026-10-15", true},
+		{"every:14:2026-10-01", "2026-10-29", true},
+		{"every:14:2026-10-01", "2026-10-08", false},
+		{"every:14:2026-10-01", "2026-09-17", false}, // before the start
+		// Days around the changes to and from daylight saving time still
+		// count as whole days
+		{"every:7:2026-03-01", "2026-03-08", true},
+		{"every:7:2026-03-01", "2026-03-15", true},
+		{"every:7:2026-03-01", "2026-03-14", false},
+		{"every:2:2026-10-30", "2026-11-01", true},
+		{"every:2:2026-10-30", "2026-11-02", false},
+
+		{"monthly:15", "2026-10-15", true},
+		{"monthly:15", "2026-10-16", false},
+		{"monthly:31", "2026-01-31", true},
+		{"monthly:31", "2026-02-28", true}, // clamped to the end of the month
+		{"monthly:31", "2026-04-30", true},
+		{"monthly:31", "2026-04-29", false},
+		{"monthly:29", "2024-02-29", true},
+		{"monthly:29", "2024-02-28", false},
+		{"monthly:29", "2026-02-28", true},
+	}
+	for _, tt := range tests {
+		rec, err := ParseRecurrence(tt.rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.OccursOn(date(tt.date)); got != tt.want {
+			t.Errorf("%s on %s = %v, want %v", tt.rec, tt.date, got, tt.want)
+		}
+	}
+}
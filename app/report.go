@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// WeeklyReport is the chores each child completed in one week, broken down
+// by day. It is shown on the report page and sent in the weekly summary.
+type WeeklyReport struct {
+	Start    time.Time // first day of the week, at midnight
+	End      time.Time // last day of the week, at midnight
+	Children []ChildReport
+}
+
+// ChildReport is one child's part of a weekly report
+type ChildReport struct {
+	User      User
+	Days      []ReportDay // every day of the week, in order
+	Points    int
+	Allowance string // credited for the week, empty until the week is credited
+}
+
+// ReportDay is the chores a child completed on one day
+type ReportDay struct {
+	Date   time.Time
+	Chores []SummaryChore
+	Points int
+}
+
+// HasChores reports whether the child completed any chore in the week
+func (c ChildReport) HasChores() bool {
+	for _, day := range c.Days {
+		if len(day.Chores) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// forChild returns the report with only the given child in it
+func (r *WeeklyReport) forChild(userID int) *WeeklyReport {
+	filtered := &WeeklyReport{Start: r.Start, End: r.End}
+	for _, child := range r.Children {
+		if child.User.ID == userID {
+			filtered.Children = append(filtered.Children, child)
+		}
+	}
+	return filtered
+}
+
+// weekStartOf returns midnight of the first day of the week containing t,
+// in t's location. Weeks start on firstDay.
+func weekStartOf(t time.Time, firstDay time.Weekday) time.Time {
+	offset := (int(t.Weekday()) - int(firstDay) + 7) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+}
+
+// lastCompleteWeek returns the start of the most recent week that ends on or
+// before t's date, so a summary sent late on the last day of a week covers
+// that week, and one sent shortly after midnight still does
+func lastCompleteWeek(t time.Time, firstDay time.Weekday) time.Time {
+	return weekStartOf(t.AddDate(0, 0, 1), firstDay).AddDate(0, 0, -7)
+}
+
+// BuildWeeklyReport builds the report of the week starting at start for the
+// given children. Points are those the ledger holds for the week's chores,
+// and the allowance is the one credited for the week.
+func BuildWeeklyReport(db *sql.DB, start time.Time, children []User) (*WeeklyReport, error) {
+	report := &WeeklyReport{Start: start, End: start.AddDate(0, 0, 6)}
+	from := report.Start.Format("2006-01-02")
+
+	rows, err := db.Query(`
+		SELECT pt.user_id, c.name, SUM(pt.amount), dc.date
+		FROM points_transactions pt
+		JOIN daily_chores dc ON pt.daily_chore_id = dc.id
+		JOIN chores c ON dc.chore_id = c.id
+		WHERE pt.source = ? AND dc.date BETWEEN ? AND ?
+		GROUP BY pt.user_id, dc.id, c.name, dc.date
+		HAVING SUM(pt.amount) <> 0
+		ORDER BY dc.date, c.name
+	`, SourceChore, from, report.End.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Chores by child and day of the week
+	completed := make(map[int][7][]SummaryChore)
+	for rows.Next() {
+		var userID int
+		var chore SummaryChore
+		var date time.Time
+		if err := rows.Scan(&userID, &chore.Name, &chore.Points, &date); err != nil {
+			return nil, err
+		}
+		i := daysBetween(report.Start, date)
+		if i < 0 || i > 6 {
+			continue
+		}
+		days := completed[userID]
+		days[i] = append(days[i], chore)
+		completed[userID] = days
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	allowances, credited, err := creditedAllowances(db, from)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		settings, err := GetAllowanceSettings(db, child.ID)
+		if err != nil {
+			return nil, err
+		}
+		childReport := ChildReport{User: child}
+		for i, chores := range completed[child.ID] {
+			day := ReportDay{Date: report.Start.AddDate(0, 0, i), Chores: chores}
+			for _, chore := range chores {
+				day.Points += chore.Points
+			}
+			childReport.Days = append(childReport.Days, day)
+			childReport.Points += day.Points
+		}
+		if credited {
+			childReport.Allowance = settings.Format(allowances[child.ID])
+		}
+		report.Children = append(report.Children, childReport)
+	}
+	return report, nil
+}
+
+// creditedAllowances returns the allowance in cents credited to each child
+// for the week starting at weekStart, and whether the week was credited yet
+func creditedAllowances(db *sql.DB, weekStart string) (map[int]int, bool, error) {
+	var credited bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM allowance_weeks WHERE week_start = ?)", weekStart).Scan(&credited)
+	if err != nil || !credited {
+		return nil, false, err
+	}
+
+	rows, err := db.Query(`
+		SELECT user_id, amount_cents FROM allowance_transactions
+		WHERE kind = ? AND week_start = ?
+	`, AllowanceEarned, weekStart)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	allowances := make(map[int]int)
+	for rows.Next() {
+		var userID, cents int
+		if err := rows.Scan(&userID, &cents); err != nil {
+			return nil, false, err
+		}
+		allowances[userID] = cents
+	}
+	return allowances, true, rows.Err()
+}
+
+// reportHandler shows the weekly report. ?week= picks the week containing
+// the given date, the current week by default. Children only see their own
+// chores.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	day := householdNow()
+	if week := r.URL.Query().Get("week"); week != "" {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", week, config.Location())
+		if err != nil {
+			http.Error(w, "Invalid week", http.StatusBadRequest)
+			return
+		}
+	}
+	start := weekStartOf(day, config.FirstWeekday())
+
+	children := []User{*user}
+	if user.Role == RoleParent {
+		var err error
+		children, err = getChildren(db)
+		if err != nil {
+			log.Printf("Error fetching children: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	report, err := BuildWeeklyReport(db, start, children)
+	if err != nil {
+		log.Printf("Error building weekly report: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Report   *WeeklyReport
+		Previous string
+		Next     string
+	}{
+		Report:   report,
+		Previous: start.AddDate(0, 0, -7).Format("2006-01-02"),
+		Next:     start.AddDate(0, 0, 7).Format("2006-01-02"),
+	}
+	templates.ExecuteTemplate(w, "report.html", data)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Review states of a daily chore. Points are only credited for approved chores.
+const (
+	StatusOpen     = "open"
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+)
+
+var (
+	errChoreNotAssigned      = errors.New("chore is not assigned to you today")
+	errChoreAlreadyApproved  = errors.New("chore has already been approved")
+	errChoreNotPending       = errors.New("chore is not waiting for review")
+	errChoreAlreadyCompleted = errors.New("chore has already been completed")
+)
+
+// PendingChore is a completed daily chore waiting for a parent's review
+type PendingChore struct {
+	ID        int
+	UserID    int
+	Username  string
+	ChoreName string
+	Points    int
+	Date      string
+}
+
+// MarkChoreCompleted records that actor has (un)done a chore assigned to
+// assignee, who is the actor themselves unless a parent acts for a child.
+// Children's completions wait for a parent's approval; chores completed by a
+// parent are approved straight away, and only parents can undo approved ones.
+func MarkChoreCompleted(db *sql.DB, actor, assignee *User, choreID int, date string, completed bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var dailyChoreID, points int
+	var status string
+	err = tx.QueryRow(`
+		SELECT dc.id, dc.status, c.points
+		FROM daily_chores dc
+		JOIN chores c ON dc.chore_id = c.id
+		WHERE dc.user_id = ? AND dc.chore_id = ? AND dc.date = ?
+	`, assignee.ID, choreID, date).Scan(&dailyChoreID, &status, &points)
+	if err == sql.ErrNoRows {
+		return errChoreNotAssigned
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case completed && status == StatusApproved:
+		return nil
+	case completed && actor.Role == RoleParent:
+		if err := setReviewStatus(tx, dailyChoreID, StatusApproved, actor.ID, ""); err != nil {
+			return err
+		}
+		err = recordPoints(tx, PointsTransaction{
+			UserID:       assignee.ID,
+			Amount:       points,
+			Source:       SourceChore,
+			ChoreID:      nullID(choreID),
+			DailyChoreID: nullID(dailyChoreID),
+			ActorID:      nullID(actor.ID),
+		})
+	case completed:
+		_, err = tx.Exec(`
+			UPDATE daily_chores
+			SET completed = TRUE, status = ?, review_note = NULL, reviewed_by = NULL, reviewed_at = NULL
+			WHERE id = ?
+		`, StatusPending, dailyChoreID)
+	case status == StatusApproved && actor.Role != RoleParent:
+		return errChoreAlreadyApproved
+	case status == StatusApproved:
+		_, err = tx.Exec("UPDATE daily_chores SET completed = FALSE, status = ? WHERE id = ?", StatusOpen, dailyChoreID)
+		if err == nil {
+			err = reverseChorePoints(tx, dailyChoreID, actor.ID, "completion undone")
+		}
+	case status == StatusPending:
+		_, err = tx.Exec("UPDATE daily_chores SET completed = FALSE, status = ? WHERE id = ?", StatusOpen, dailyChoreID)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ApproveChore approves a pending daily chore and credits its points
+func ApproveChore(db *sql.DB, dailyChoreID int, reviewerID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID, choreID, points int
+	err = tx.QueryRow(`
+		SELECT dc.user_id, dc.chore_id, c.points
+		FROM daily_chores dc
+		JOIN chores c ON dc.chore_id = c.id
+		WHERE dc.id = ? AND dc.status = ?
+	`, dailyChoreID, StatusPending).Scan(&userID, &choreID, &points)
+	if err == sql.ErrNoRows {
+		return errChoreNotPending
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := setReviewStatus(tx, dailyChoreID, StatusApproved, reviewerID, ""); err != nil {
+		return err
+	}
+	err = recordPoints(tx, PointsTransaction{
+		UserID:       userID,
+		Amount:       points,
+		Source:       SourceChore,
+		ChoreID:      nullID(choreID),
+		DailyChoreID: nullID(dailyChoreID),
+		ActorID:      nullID(reviewerID),
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RejectChore sends a pending daily chore back to the child with a note.
+// Rejecting an approved chore takes back the points credited for it.
+func RejectChore(db *sql.DB, dailyChoreID int, reviewerID int, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow("SELECT status FROM daily_chores WHERE id = ?", dailyChoreID).Scan(&status)
+	if err == sql.ErrNoRows || (err == nil && status != StatusPending && status != StatusApproved) {
+		return errChoreNotPending
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := setReviewStatus(tx, dailyChoreID, StatusRejected, reviewerID, note); err != nil {
+		return err
+	}
+	if status == StatusApproved {
+		if err := reverseChorePoints(tx, dailyChoreID, reviewerID, "approval withdrawn"); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPendingChores returns all completed chores waiting for review, oldest first
+func GetPendingChores(db *sql.DB) ([]PendingChore, error) {
+	rows, err := db.Query(`
+		SELECT dc.id, dc.user_id, u.username, c.name, c.points, dc.date
+		FROM daily_chores dc
+		JOIN users u ON dc.user_id = u.id
+		JOIN chores c ON dc.chore_id = c.id
+		WHERE dc.status = ?
+		ORDER BY dc.date, u.username, c.name
+	`, StatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []PendingChore{}
+	for rows.Next() {
+		var p PendingChore
+		var date time.Time
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Username, &p.ChoreName, &p.Points, &date); err != nil {
+			return nil, err
+		}
+		p.Date = date.Format("2006-01-02")
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+func setReviewStatus(tx *sql.Tx, dailyChoreID int, status string, reviewerID int, note string) error {
+	_, err := tx.Exec(`
+		UPDATE daily_chores
+		SET completed = ?, status = ?, review_note = ?, reviewed_by = ?, reviewed_at = ?
+		WHERE id = ?
+	`, status == StatusApproved, status, note, reviewerID, time.Now().Unix(), dailyChoreID)
+	return err
+}
+
+// reviewPageHandler shows parents the chores waiting for their review
+func reviewPageHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := GetPendingChores(db)
+	if err != nil {
+		log.Printf("Error fetching pending chores: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "review.html", struct{ Pending []PendingChore }{Pending: pending})
+}
+
+// getPendingChoresHandler returns the review queue as JSON
+func getPendingChoresHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := GetPendingChores(db)
+	if err != nil {
+		log.Printf("Error fetching pending chores: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pending); err != nil {
+		log.Printf("Error encoding pending chores to JSON: %v", err)
+	}
+}
+
+// reviewChoreHandler approves or rejects a pending chore
+func reviewChoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	dailyChoreID, err := strconv.Atoi(r.FormValue("daily_chore_id"))
+	if err != nil {
+		http.Error(w, "Invalid daily chore ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "approve":
+		err = ApproveChore(db, dailyChoreID, user.ID)
+	case "reject":
+		err = RejectChore(db, dailyChoreID, user.ID, r.FormValue("note"))
+	default:
+		http.Error(w, "Invalid review action", http.StatusBadRequest)
+		return
+	}
+	if err == errChoreNotPending {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reviewing chore: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/review", http.StatusFound)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of a reward redemption
+const (
+	RedemptionPending  = "pending"
+	RedemptionApproved = "approved"
+	RedemptionRejected = "rejected"
+)
+
+var (
+	errRewardNotFound       = errors.New("reward not found")
+	errNotEnoughPoints      = errors.New("not enough points for this reward")
+	errRedemptionNotPending = errors.New("redemption is not waiting for review")
+)
+
+// Reward is something parents offer in exchange for points
+type Reward struct {
+	ID               int
+	Name             string
+	Cost             int
+	RequiresApproval bool
+	Active           bool
+}
+
+// Redemption is a child's request to exchange points for a reward
+type Redemption struct {
+	ID         int
+	UserID     int
+	Username   string
+	RewardID   int
+	RewardName string
+	Cost       int
+	Status     string
+	Note       string
+	CreatedAt  time.Time
+}
+
+// GetRewards returns the reward catalog, optionally only the active rewards
+func GetRewards(db *sql.DB, activeOnly bool) ([]Reward, error) {
+	query := "SELECT id, name, cost, requires_approval, active FROM rewards"
+	if activeOnly {
+		query += " WHERE active = TRUE"
+	}
+	rows, err := db.Query(query + " ORDER BY cost, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rewards []Reward
+	for rows.Next() {
+		var reward Reward
+		if err := rows.Scan(&reward.ID, &reward.Name, &reward.Cost, &reward.RequiresApproval, &reward.Active); err != nil {
+			return nil, err
+		}
+		rewards = append(rewards, reward)
+	}
+	return rewards, rows.Err()
+}
+
+// CreateReward adds a reward to the catalog
+func CreateReward(db *sql.DB, name string, cost int, requiresApproval bool) error {
+	_, err := db.Exec("INSERT INTO rewards (name, cost, requires_approval) VALUES (?, ?, ?)", name, cost, requiresApproval)
+	return err
+}
+
+// UpdateReward changes a reward in the catalog. Existing redemptions keep
+// the cost they were made at.
+func UpdateReward(db *sql.DB, reward Reward) error {
+	res, err := db.Exec(`
+		UPDATE rewards SET name = ?, cost = ?, requires_approval = ?, active = ? WHERE id = ?
+	`, reward.Name, reward.Cost, reward.RequiresApproval, reward.Active, reward.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errRewardNotFound
+	}
+	return err
+}
+
+// RedeemReward exchanges the user's points for a reward. The points are
+// taken right away; if the reward needs a parent's approval they are
+// refunded when the redemption is rejected.
+func RedeemReward(db *sql.DB, user *User, rewardID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var reward Reward
+	err = tx.QueryRow(`
+		SELECT id, name, cost, requires_approval FROM rewards WHERE id = ? AND active = TRUE
+	`, rewardID).Scan(&reward.ID, &reward.Name, &reward.Cost, &reward.RequiresApproval)
+	if err == sql.ErrNoRows {
+		return errRewardNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var balance int
+	err = tx.QueryRow("SELECT IFNULL(SUM(amount), 0) FROM points_transactions WHERE user_id = ?", user.ID).Scan(&balance)
+	if err != nil {
+		return err
+	}
+	if balance < reward.Cost {
+		return errNotEnoughPoints
+	}
+
+	status := RedemptionApproved
+	if reward.RequiresApproval {
+		status = RedemptionPending
+	}
+	_, err = tx.Exec(`
+		INSERT INTO reward_redemptions (user_id, reward_id, cost, status, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, user.ID, reward.ID, reward.Cost, status, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	err = recordPoints(tx, PointsTransaction{
+		UserID:  user.ID,
+		Amount:  -reward.Cost,
+		Source:  SourceReward,
+		ActorID: nullID(user.ID),
+		Note:    reward.Name,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReviewRedemption approves or rejects a pending redemption. Rejected
+// redemptions get their points refunded.
+func ReviewRedemption(db *sql.DB, redemptionID, reviewerID int, approve bool, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID, cost int
+	var rewardName string
+	err = tx.QueryRow(`
+		SELECT rr.user_id, rr.cost, r.name
+		FROM reward_redemptions rr
+		JOIN rewards r ON rr.reward_id = r.id
+		WHERE rr.id = ? AND rr.status = ?
+	`, redemptionID, RedemptionPending).Scan(&userID, &cost, &rewardName)
+	if err == sql.ErrNoRows {
+		return errRedemptionNotPending
+	}
+	if err != nil {
+		return err
+	}
+
+	status := RedemptionApproved
+	if !approve {
+		status = RedemptionRejected
+	}
+	_, err = tx.Exec(`
+		UPDATE reward_redemptions SET status = ?, note = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ?
+	`, status, note, reviewerID, time.Now().Unix(), redemptionID)
+	if err != nil {
+		return err
+	}
+
+	if !approve {
+		err = recordPoints(tx, PointsTransaction{
+			UserID:  userID,
+			Amount:  cost,
+			Source:  SourceRewardRefund,
+			ActorID: nullID(reviewerID),
+			Note:    rewardName,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetRedemptions returns redemptions, newest first. A userID of 0 returns
+// everyone's, an empty status any status.
+func GetRedemptions(db *sql.DB, userID int, status string, limit int) ([]Redemption, error) {
+	rows, err := db.Query(`
+		SELECT rr.id, rr.user_id, u.username, rr.reward_id, r.name, rr.cost, rr.status, IFNULL(rr.note, ''), rr.created_at
+		FROM reward_redemptions rr
+		JOIN rewards r ON rr.reward_id = r.id
+		JOIN users u ON rr.user_id = u.id
+		WHERE (? = 0 OR rr.user_id = ?) AND (? = '' OR rr.status = ?)
+		ORDER BY rr.id DESC
+		LIMIT ?
+	`, userID, userID, status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var redemptions []Redemption
+	for rows.Next() {
+		var rr Redemption
+		var createdAt int64
+		if err := rows.Scan(&rr.ID, &rr.UserID, &rr.Username, &rr.RewardID, &rr.RewardName, &rr.Cost, &rr.Status, &rr.Note, &createdAt); err != nil {
+			return nil, err
+		}
+		rr.CreatedAt = time.Unix(createdAt, 0).In(config.Location())
+		redemptions = append(redemptions, rr)
+	}
+	return redemptions, rows.Err()
+}
+
+// rewardsHandler shows the reward store. Children can redeem rewards,
+// parents manage the catalog and review pending redemptions.
+func rewardsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	isParent := user.Role == RoleParent
+	rewards, err := GetRewards(db, !isParent)
+	if err != nil {
+		log.Printf("Error fetching rewards: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var pending []Redemption
+	if isParent {
+		pending, err = GetRedemptions(db, 0, RedemptionPending, 100)
+		if err != nil {
+			log.Printf("Error fetching redemptions: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := struct {
+		User     *User
+		IsParent bool
+		Rewards  []Reward
+		Pending  []Redemption
+	}{
+		User:     user,
+		IsParent: isParent,
+		Rewards:  rewards,
+		Pending:  pending,
+	}
+	templates.ExecuteTemplate(w, "rewards.html", data)
+}
+
+// createRewardHandler adds a reward to the catalog
+func createRewardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reward, err := parseRewardForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := CreateReward(db, reward.Name, reward.Cost, reward.RequiresApproval); err != nil {
+		log.Printf("Error creating reward: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/rewards", http.StatusFound)
+}
+
+// updateRewardHandler changes or (de)activates a reward
+func updateRewardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reward, err := parseRewardForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reward.ID, err = strconv.Atoi(r.FormValue("reward_id"))
+	if err != nil {
+		http.Error(w, "Invalid reward ID", http.StatusBadRequest)
+		return
+	}
+	reward.Active = r.FormValue("active") == "true"
+
+	err = UpdateReward(db, reward)
+	if err == errRewardNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating reward: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/rewards", http.StatusFound)
+}
+
+// redeemRewardHandler exchanges the current user's points for a reward
+func redeemRewardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	rewardID, err := strconv.Atoi(r.FormValue("reward_id"))
+	if err != nil {
+		http.Error(w, "Invalid reward ID", http.StatusBadRequest)
+		return
+	}
+
+	err = RedeemReward(db, user, rewardID)
+	switch err {
+	case nil:
+	case errRewardNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errNotEnoughPoints:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		log.Printf("Error redeeming reward: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// reviewRedemptionHandler approves or rejects a pending redemption
+func reviewRedemptionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	redemptionID, err := strconv.Atoi(r.FormValue("redemption_id"))
+	if err != nil {
+		http.Error(w, "Invalid redemption ID", http.StatusBadRequest)
+		return
+	}
+
+	var approve bool
+	switch r.FormValue("action") {
+	case "approve":
+		approve = true
+	case "reject":
+	default:
+		http.Error(w, "Invalid review action", http.StatusBadRequest)
+		return
+	}
+
+	err = ReviewRedemption(db, redemptionID, user.ID, approve, r.FormValue("note"))
+	if err == errRedemptionNotPending {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reviewing redemption: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/rewards", http.StatusFound)
+}
+
+func parseRewardForm(r *http.Request) (Reward, error) {
+	reward := Reward{
+		Name:             strings.TrimSpace(r.FormValue("name")),
+		RequiresApproval: r.FormValue("requires_approval") == "true",
+	}
+	if reward.Name == "" {
+		return reward, errors.New("missing reward name")
+	}
+	cost, err := strconv.Atoi(r.FormValue("cost"))
+	if err != nil || cost <= 0 {
+		return reward, errors.New("invalid cost")
+	}
+	reward.Cost = cost
+	return reward, nil
+}
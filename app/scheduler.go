@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Job is a task run by the scheduler. Run gets the time the run was
+// scheduled for, which lies in the past when a missed run is caught up.
+//
+// Jobs with Run are marked as run before they start, so a run that fails
+// or is interrupted by a restart is not repeated. Jobs with RunTx run in the
+// same transaction that marks them as run and therefore happen exactly once;
+// a failed run is rolled back and retried a minute later.
+type Job struct {
+	Name     string
+	Schedule string // cron expression, see ParseCron
+	Run      func(at time.Time) error
+	RunTx    func(tx *sql.Tx, at time.Time) error
+}
+
+// Scheduler runs jobs on their schedules and records each run in the jobs
+// table, so runs missed while the server was down are caught up on startup
+type Scheduler struct {
+	db   *sql.DB
+	jobs []scheduledJob
+}
+
+type scheduledJob struct {
+	Job
+	schedule CronSchedule
+}
+
+// NewScheduler returns a scheduler without jobs
+func NewScheduler(db *sql.DB) *Scheduler {
+	return &Scheduler{db: db}
+}
+
+// Add registers a job. A job that has never run before is first run at its
+// next scheduled time rather than caught up.
+func (s *Scheduler) Add(job Job) error {
+	if expr, ok := config.Schedules[job.Name]; ok {
+		job.Schedule = expr
+	}
+	schedule, err := ParseCron(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", job.Name, err)
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO jobs (name, last_run_at) VALUES (?, ?)
+		ON CONFLICT (name) DO NOTHING
+	`, job.Name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	s.jobs = append(s.jobs, scheduledJob{Job: job, schedule: schedule})
+	return nil
+}
+
+// Start catches up missed runs and then checks for due jobs every minute,
+// until ctx is cancelled. Schedules are in the household's timezone. A job
+// that is running when ctx is cancelled is finished first.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.runDue(ctx, householdNow())
+	for {
+		now := time.Now()
+		select {
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		case <-ctx.Done():
+			return
+		}
+		s.runDue(ctx, householdNow())
+	}
+}
+
+// runDue runs every job that was due at or before now, in the order they
+// were added, so jobs due at the same time can depend on the ones added
+// before them. A job that missed several runs only runs once, for the most
+// recent one. Jobs not started before ctx is cancelled wait for the next
+// start.
+func (s *Scheduler) runDue(ctx context.Context, now time.Time) {
+	for _, job := range s.jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		var lastRunAt int64
+		err := s.db.QueryRow("SELECT last_run_at FROM jobs WHERE name = ?", job.Name).Scan(&lastRunAt)
+		if err != nil {
+			log.Printf("Error reading job %s: %v", job.Name, err)
+			continue
+		}
+
+		due := job.schedule.Next(time.Unix(lastRunAt, 0).In(now.Location()))
+		if due.IsZero() || due.After(now) {
+			continue
+		}
+		missed := 0
+		for next := job.schedule.Next(due); !next.IsZero() && !next.After(now); next = job.schedule.Next(due) {
+			due = next
+			missed++
+		}
+		if missed > 0 {
+			log.Printf("Job %s missed %d runs, running once for %s", job.Name, missed, due.Format(time.RFC1123))
+		}
+
+		if err := s.run(job, lastRunAt, due); err != nil {
+			log.Printf("Job %s failed: %v", job.Name, err)
+			s.db.Exec("UPDATE jobs SET last_error = ? WHERE name = ?", err.Error(), job.Name)
+		}
+	}
+}
+
+// run marks the job as run for due and runs it. The mark only succeeds if
+// last_run_at is unchanged, so a run is never started twice.
+func (s *Scheduler) run(job scheduledJob, lastRunAt int64, due time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE jobs SET last_run_at = ?, last_error = NULL WHERE name = ? AND last_run_at = ?
+	`, due.Unix(), job.Name, lastRunAt)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return err
+	}
+
+	if job.RunTx != nil {
+		if err := job.RunTx(tx, due); err != nil {
+			return err
+		}
+		return s.finish(tx, job.Name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := job.Run(due); err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE jobs SET last_finished_at = ? WHERE name = ?", time.Now().Unix(), job.Name)
+	return err
+}
+
+// finish records that a transactional job completed and commits it
+func (s *Scheduler) finish(tx *sql.Tx, name string) error {
+	_, err := tx.Exec("UPDATE jobs SET last_finished_at = ? WHERE name = ?", time.Now().Unix(), name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
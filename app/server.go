@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Listen modes
+const (
+	ListenModeTLS  = "tls"  // HTTPS with the server's own certificate
+	ListenModeHTTP = "http" // plain HTTP, for development or behind a reverse proxy
+)
+
+// shutdownTimeout is how long requests in flight get to finish on shutdown.
+// docker stop waits stop_grace_period (see docker-compose.yml) before it
+// kills the server.
+const shutdownTimeout = 20 * time.Second
+
+// acmeChallengePath is where ACME servers fetch HTTP-01 challenge responses
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// serve runs the server in the configured listen mode, along with the
+// redirect listener if there is one, until ctx is cancelled or a listener
+// fails. It then stops accepting connections and waits up to
+// shutdownTimeout for the requests in flight.
+func serve(ctx context.Context, handler http.Handler) error {
+	handler = proxyHandler(config.trustedProxies, handler)
+
+	var servers []*http.Server
+	errs := make(chan error, 2)
+	listen := func(server *http.Server, listenAndServe func() error) {
+		servers = append(servers, server)
+		go func() {
+			if err := listenAndServe(); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	if config.ListenMode == ListenModeHTTP {
+		log.Printf("Server starting on %s (plain HTTP)", config.ListenAddr)
+		server := &http.Server{Addr: config.ListenAddr, Handler: handler}
+		listen(server, server.ListenAndServe)
+	} else {
+		if config.HTTPRedirectAddr != "" {
+			log.Printf("Redirecting HTTP on %s to HTTPS", config.HTTPRedirectAddr)
+			redirect := &http.Server{Addr: config.HTTPRedirectAddr, Handler: redirectHandler(config)}
+			listen(redirect, redirect.ListenAndServe)
+		}
+		log.Printf("Server starting on %s", config.ListenAddr)
+		server := &http.Server{
+			Addr:      config.ListenAddr,
+			Handler:   handler,
+			TLSConfig: &tls.Config{GetCertificate: certificates.GetCertificate},
+		}
+		listen(server, func() error { return server.ListenAndServeTLS("", "") })
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		log.Print("Shutting down, waiting for requests in flight")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down server on %s: %v", server.Addr, err)
+		}
+	}
+	return err
+}
+
+// redirectHandler sends plain HTTP requests to the same URL over HTTPS,
+// except ACME HTTP-01 challenges, which it serves from the challenge
+// directory (e.g. certbot's --webroot-path) if one is configured
+func redirectHandler(cfg Config) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(cfg.ListenAddr)
+	var challenges http.Handler
+	if cfg.ACMEChallengeDir != "" {
+		challenges = http.StripPrefix(acmeChallengePath, http.FileServer(http.Dir(cfg.ACMEChallengeDir)))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			if challenges == nil {
+				http.NotFound(w, r)
+				return
+			}
+			challenges.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// proxyHandler takes the client address and scheme from the X-Forwarded-For
+// and X-Forwarded-Proto headers of requests from trusted proxies, and drops
+// those headers from everyone else so that clients can't spoof them
+func proxyHandler(trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isTrustedProxy(trusted, remoteIP(r.RemoteAddr)) {
+			r.Header.Del("X-Forwarded-For")
+			r.Header.Del("X-Forwarded-Proto")
+		} else if client := forwardedClient(trusted, r.Header.Values("X-Forwarded-For")); client != "" {
+			r.RemoteAddr = client
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient returns the client address from X-Forwarded-For headers:
+// the last address that isn't one of our proxies, as everything before it
+// was sent by the client and can't be trusted
+func forwardedClient(trusted []*net.IPNet, headers []string) string {
+	var hops []string
+	for _, header := range headers {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			return ""
+		}
+		if i == 0 || !isTrustedProxy(trusted, ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// isHTTPS reports whether the client reached us over HTTPS, directly or
+// through a trusted proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// isTrustedProxy reports whether ip belongs to one of the trusted networks
+func isTrustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, network := range trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of a request's RemoteAddr
+func remoteIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// parseTrustedProxies parses addresses and CIDR networks, e.g. 127.0.0.1 or
+// 172.16.0.0/12
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// serverHandler shows parents how the server is doing: the certificate and
+// the dynamic DNS records
+func serverHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, err := GetDynDNSStatuses(db)
+	if err != nil {
+		log.Printf("Error fetching dynamic DNS status: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		ListenMode     string
+		Certificate    *certificateStatus
+		CertificateErr string
+		DynDNSEnabled  bool
+		DynDNSStatuses []DynDNSStatus
+	}{
+		ListenMode:     config.ListenMode,
+		DynDNSEnabled:  config.DynDNS.Enabled,
+		DynDNSStatuses: statuses,
+	}
+	if certificates != nil {
+		cert, err := certificates.GetCertificate(nil)
+		if err != nil {
+			data.CertificateErr = err.Error()
+		} else {
+			data.Certificate = &certificateStatus{
+				Domains:         cert.Leaf.DNSNames,
+				NotAfter:        cert.Leaf.NotAfter.In(config.Location()),
+				DaysUntilExpiry: daysUntilExpiry(cert.Leaf),
+			}
+		}
+	}
+	templates.ExecuteTemplate(w, "server.html", data)
+}
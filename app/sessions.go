@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	// sessionIdleTimeout is how long a session survives without requests
+	sessionIdleTimeout = 7 * 24 * time.Hour
+	// sessionMaxLifetime is how long a session survives at most, however active
+	sessionMaxLifetime = 30 * 24 * time.Hour
+	// sessionTouchInterval limits how often last-seen times are written back
+	sessionTouchInterval = time.Minute
+)
+
+var errSessionNotFound = errors.New("session not found or expired")
+
+// generateSessionID returns a new session token with 256 bits of entropy
+func generateSessionID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS entropy source is unavailable
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashSessionID returns the form of a session token stored in the database,
+// so that a copy of the database cannot be used to forge session cookies
+func hashSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession stores a new session for the user and returns its token.
+// Only a hash of the token is kept in the database.
+func CreateSession(db *sql.DB, userID int) (string, error) {
+	if err := DeleteExpiredSessions(db); err != nil {
+		return "", err
+	}
+
+	sessionID := generateSessionID()
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO sessions (id, user_id, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, hashSessionID(sessionID), userID, now.Unix(), now.Unix(), now.Add(sessionIdleTimeout).Unix())
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// LookupSession returns the user ID of a live session and slides its expiry
+func LookupSession(db *sql.DB, sessionID string) (int, error) {
+	var userID int
+	var createdAt, lastSeenAt, expiresAt int64
+	err := db.QueryRow(`
+		SELECT user_id, created_at, last_seen_at, expires_at FROM sessions WHERE id = ?
+	`, hashSessionID(sessionID)).Scan(&userID, &createdAt, &lastSeenAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, errSessionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if now.Unix() >= expiresAt {
+		return 0, errSessionNotFound
+	}
+
+	if now.Sub(time.Unix(lastSeenAt, 0)) >= sessionTouchInterval {
+		expires := now.Add(sessionIdleTimeout)
+		if limit := time.Unix(createdAt, 0).Add(sessionMaxLifetime); expires.After(limit) {
+			expires = limit
+		}
+		_, err = db.Exec(`
+			UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?
+		`, now.Unix(), expires.Unix(), hashSessionID(sessionID))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return userID, nil
+}
+
+// DeleteSession revokes a session
+func DeleteSession(db *sql.DB, sessionID string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE id = ?", hashSessionID(sessionID))
+	return err
+}
+
+// RevokeUserSessions revokes all sessions of a user. Call it whenever the
+// user's role or password changes so they have to log in again.
+func RevokeUserSessions(db *sql.DB, userID int) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// DeleteExpiredSessions removes all sessions past their expiry
+func DeleteExpiredSessions(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now().Unix())
+	return err
+}
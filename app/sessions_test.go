@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLookupSessionSlidesExpiry(t *testing.T) {
+	db := newTestDB(t)
+	user := addTestUser(t, db, "kid", RoleChild)
+
+	tests := []struct {
+		name        string
+		age         time.Duration // since the session was created
+		idle        time.Duration // since it was last seen
+		expiresIn   time.Duration
+		found       bool
+		wantExpires time.Duration // from now, after the lookup
+	}{
+		{"fresh", 0, 0, sessionIdleTimeout, true, sessionIdleTimeout},
+		{"seen recently is not touched", time.Hour, 30 * time.Second, time.Hour, true, time.Hour},
+		{"idle slides", 2 * 24 * time.Hour, 24 * time.Hour, 6 * 24 * time.Hour, true, sessionIdleTimeout},
+		{"capped at the lifetime", sessionMaxLifetime - 24*time.Hour, 24 * time.Hour, 6 * 24 * time.Hour, true, 24 * time.Hour},
+		{"expired", 10 * 24 * time.Hour, 8 * 24 * time.Hour, -24 * time.Hour, false, 0},
+	}
+	for _, tt := range tests {
+		sessionID, err := CreateSession(db, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		_, err = db.Exec(`
+			UPDATE sessions SET created_at = ?, last_seen_at = ?, expires_at = ? WHERE id = ?
+		`, now.Add(-tt.age).Unix(), now.Add(-tt.idle).Unix(), now.Add(tt.expiresIn).Unix(), hashSessionID(sessionID))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := LookupSession(db, sessionID)
+		if !tt.found {
+			if err != errSessionNotFound {
+				t.Errorf("%s: LookupSession = %d, %v, want %v", tt.name, got, err, errSessionNotFound)
+			}
+			continue
+		}
+		if err != nil || got != user {
+			t.Errorf("%s: LookupSession = %d, %v, want %d", tt.name, got, err, user)
+			continue
+		}
+		var expiresAt int64
+		if err := db.QueryRow("SELECT expires_at FROM sessions WHERE id = ?", hashSessionID(sessionID)).Scan(&expiresAt); err != nil {
+			t.Fatal(err)
+		}
+		if diff := time.Unix(expiresAt, 0).Sub(now.Add(tt.wantExpires)); diff < -2*time.Second || diff > 2*time.Second {
+			t.Errorf("%s: expires at %v, want about %v", tt.name, time.Unix(expiresAt, 0), now.Add(tt.wantExpires))
+		}
+	}
+}
+
+func TestSessionRevocation(t *testing.T) {
+	db := newTestDB(t)
+	kid := addTestUser(t, db, "kid", RoleChild)
+	parent := addTestUser(t, db, "parent", RoleParent)
+
+	newSession := func(userID int) string {
+		sessionID, err := CreateSession(db, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sessionID
+	}
+	kidPhone, kidLaptop, parentPhone := newSession(kid), newSession(kid), newSession(parent)
+
+	if err := DeleteSession(db, kidPhone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupSession(db, kidPhone); err != errSessionNotFound {
+		t.Errorf("logged out session: %v, want %v", err, errSessionNotFound)
+	}
+	if _, err := LookupSession(db, kidLaptop); err != nil {
+		t.Errorf("other session of the same user: %v", err)
+	}
+
+	if err := RevokeUserSessions(db, kid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupSession(db, kidLaptop); err != errSessionNotFound {
+		t.Errorf("revoked session: %v, want %v", err, errSessionNotFound)
+	}
+	if _, err := LookupSession(db, parentPhone); err != nil {
+		t.Errorf("other user's session after revoking: %v", err)
+	}
+
+	// The stored ID is a hash, so the database alone doesn't give away a cookie
+	var stored string
+	if err := db.QueryRow("SELECT id FROM sessions WHERE user_id = ?", parent).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == parentPhone || stored != hashSessionID(parentPhone) {
+		t.Errorf("stored session ID %q, want the hash of the token", stored)
+	}
+}
@@ -140,8 +140,11 @@ function updateChoresList(chores) {
                         <input type="checkbox" name="completed_checkbox" ${chore.Completed ? 'checked' : ''} onchange="handleChoreCompletion(this)">
                         ${chore.Name} (${chore.Points} points)
                     </label>
+                    <span class="review-status"></span>
                 </form>
             `;
+            // The review note is free text, so it must not be parsed as HTML
+            listItem.querySelector('.review-status').textContent = reviewStatusText(chore);
             choresForTodayList.appendChild(listItem);
         });
     } else {
@@ -171,6 +174,20 @@ function updateChoresList(chores) {
     }
 }
 
+// Describe where a completed chore is in the parent review process
+function reviewStatusText(chore) {
+    switch (chore.Status) {
+    case 'pending':
+        return 'waiting for approval';
+    case 'approved':
+        return 'approved';
+    case 'rejected':
+        return chore.ReviewNote ? `rejected: ${chore.ReviewNote}` : 'rejected';
+    default:
+        return '';
+    }
+}
+
 async function initializeChores() {
     try {
         const response = await fetch('/chores');
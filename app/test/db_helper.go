@@ -7,20 +7,28 @@ import (
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"chore-tracker/app/migrations"
 )
 
 func dropTables(db *sql.DB) error {
-	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table'")
+	// Collect the names first, tables can't be dropped while being listed
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'")
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
+	var tableNames []string
 	for rows.Next() {
 		var tableName string
 		if err := rows.Scan(&tableName); err != nil {
+			rows.Close()
 			return err
 		}
+		tableNames = append(tableNames, tableName)
+	}
+	rows.Close()
+
+	for _, tableName := range tableNames {
 		if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS \"%s\"", tableName)); err != nil {
 			return err
 		}
@@ -28,54 +36,32 @@ func dropTables(db *sql.DB) error {
 	return nil
 }
 
+// createTables builds the schema with the same migrations the server runs
 func createTables(db *sql.DB) error {
-	createTablesSQL := []string{
-		`CREATE TABLE users (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            username TEXT UNIQUE NOT NULL,
-            hash TEXT NOT NULL,
-            email TEXT NOT NULL,
-            role TEXT NOT NULL,
-            points INTEGER DEFAULT 0
-          );`,
-		`CREATE TABLE chores (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            name TEXT UNIQUE NOT NULL,
-            points INTEGER NOT NULL,
-            default_user_id INTEGER,
-            FOREIGN KEY (default_user_id) REFERENCES users(id)
-          );`,
-		`CREATE TABLE daily_chores (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            user_id INTEGER NOT NULL,
-            chore_id INTEGER NOT NULL,
-            date DATE NOT NULL,
-            completed BOOLEAN DEFAULT FALSE,
-            UNIQUE(chore_id, date), -- Add this line
-            FOREIGN KEY (user_id) REFERENCES users(id),
-            FOREIGN KEY (chore_id) REFERENCES chores(id)
-          );`,
-	}
-
-	for _, sql := range createTablesSQL {
-		if _, err := db.Exec(sql); err != nil {
-			return err
-		}
-	}
-	return nil
+	_, err := migrations.Run(db)
+	return err
 }
 
 func insertData(db *sql.DB) error {
 	insertDataSQL := []string{
-		`INSERT INTO users (username, hash, email, role, points) VALUES
-            ('WitweBolte', '', 'bolte@wilhelmbusch.uk', 'parent', 15),
-            ('Max', '', 'max@wilhelmbusch.uk', 'child', 15),
-            ('Moritz', '', 'moritz@wilhelmbusch.uk', 'child', 6);`,
-		`INSERT INTO chores (name, points, default_user_id) VALUES
-            ('walk dog morning', 5, 1),
-            ('walk dog afternoon', 5, 1),
-            ('walk dog evening', 5, 1),
-            ('Cat litter cleanup', 1, 3);`,
+		`INSERT INTO users (username, hash, email, role) VALUES
+            ('WitweBolte', '', 'bolte@wilhelmbusch.uk', 'parent'),
+            ('Max', '', 'max@wilhelmbusch.uk', 'child'),
+            ('Moritz', '', 'moritz@wilhelmbusch.uk', 'child');`,
+		`INSERT INTO points_transactions (user_id, amount, source, created_at) VALUES
+            (1, 15, 'opening_balance', strftime('%s', 'now')),
+            (2, 15, 'opening_balance', strftime('%s', 'now')),
+            (3, 6, 'opening_balance', strftime('%s', 'now'));`,
+		`INSERT INTO chores (name, points, default_user_id, recurrence) VALUES
+            ('walk dog morning', 5, 1, 'daily'),
+            ('walk dog afternoon', 5, 1, 'weekdays'),
+            ('walk dog evening', 5, 1, 'daily'),
+            ('Cat litter cleanup', 1, 3, 'every:2:2024-01-01'),
+            ('Take out trash', 2, 2, 'weekly:tue'),
+            ('Change bedsheets', 3, 2, 'every:14:2024-01-01');`,
+		`INSERT INTO rewards (name, cost, requires_approval) VALUES
+            ('30 min screen time', 20, FALSE),
+            ('Pick the family movie', 30, TRUE);`,
 	}
 
 	for _, sql := range insertDataSQL {
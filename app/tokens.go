@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API token scopes. A token never allows more than its user could do.
+const (
+	ScopeRead     = "read"     // read everything the user can see
+	ScopeComplete = "complete" // read, and tick off daily chores
+	ScopeFull     = "full"     // everything the user can do
+)
+
+var errTokenNotFound = errors.New("API token not found or revoked")
+
+// APIToken is a named token that scripts and devices use to call the API
+// as a user, sent as "Authorization: Bearer <token>". Only a hash of the
+// token is stored, so it is shown once when created.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Username   string
+	Name       string
+	Scope      string
+	CreatedAt  time.Time
+	LastUsedAt time.Time // zero if never used
+	Revoked    bool
+}
+
+type apiScopeKey struct{}
+
+// validScope reports whether scope is one of the known token scopes
+func validScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeComplete || scope == ScopeFull
+}
+
+// CreateAPIToken stores a new token acting as the user and returns it
+func CreateAPIToken(db *sql.DB, userID int, name, scope string) (string, error) {
+	token := generateSessionID()
+	_, err := db.Exec(`
+		INSERT INTO api_tokens (user_id, name, hash, scope, created_at) VALUES (?, ?, ?, ?, ?)
+	`, userID, name, hashSessionID(token), scope, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LookupAPIToken returns the live token matching the given one and records
+// that it was used
+func LookupAPIToken(db *sql.DB, token string) (*APIToken, error) {
+	var t APIToken
+	var lastUsedAt sql.NullInt64
+	err := db.QueryRow(`
+		SELECT id, user_id, name, scope, last_used_at FROM api_tokens WHERE hash = ? AND revoked_at IS NULL
+	`, hashSessionID(token)).Scan(&t.ID, &t.UserID, &t.Name, &t.Scope, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, errTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !lastUsedAt.Valid || now.Sub(time.Unix(lastUsedAt.Int64, 0)) >= sessionTouchInterval {
+		if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now.Unix(), t.ID); err != nil {
+			return nil, err
+		}
+	}
+	t.LastUsedAt = now
+	return &t, nil
+}
+
+// GetAPITokens returns all tokens, live ones first and newest first
+func GetAPITokens(db *sql.DB) ([]APIToken, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.user_id, u.username, t.name, t.scope, t.created_at, t.last_used_at, t.revoked_at IS NOT NULL
+		FROM api_tokens t
+		JOIN users u ON t.user_id = u.id
+		ORDER BY t.revoked_at IS NOT NULL, t.created_at DESC, t.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		var createdAt int64
+		var lastUsedAt sql.NullInt64
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Username, &t.Name, &t.Scope, &createdAt, &lastUsedAt, &t.Revoked); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = time.Unix(createdAt, 0).In(config.Location())
+		if lastUsedAt.Valid {
+			t.LastUsedAt = time.Unix(lastUsedAt.Int64, 0).In(config.Location())
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken stops a token from working. It returns sql.ErrNoRows if
+// there is no such token.
+func RevokeAPIToken(db *sql.DB, id int) error {
+	result, err := db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = sql.ErrNoRows
+	}
+	return err
+}
+
+// authenticateAPI returns the user making an API request and the scope they
+// have, from a bearer token or else the session cookie. It writes a 401
+// response and returns nil if neither is valid.
+func authenticateAPI(w http.ResponseWriter, r *http.Request) (*User, string) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		user := getCurrentUser(r)
+		if user == nil {
+			writeAPIError(w, http.StatusUnauthorized, "not logged in")
+			return nil, ""
+		}
+		return user, ScopeFull
+	}
+
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chores"`)
+		writeAPIError(w, http.StatusUnauthorized, "expected a bearer token")
+		return nil, ""
+	}
+	t, err := LookupAPIToken(db, strings.TrimSpace(token))
+	if err != nil && err != errTokenNotFound {
+		log.Printf("Error looking up API token: %v", err)
+	}
+	var user *User
+	if err == nil {
+		user, err = GetUserByID(db, t.UserID)
+	}
+	if err != nil || user.Archived {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chores", error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, "invalid or revoked token")
+		return nil, ""
+	}
+	return user, t.Scope
+}
+
+// scopeAllows reports whether a token with the scope may make a request
+// with the method to the resource. Handlers check the details, e.g. that a
+// complete token only changes whether a chore is done.
+func scopeAllows(scope, resource, method string, id int) bool {
+	switch {
+	case scope == ScopeFull:
+		return true
+	case method == "GET" || method == "HEAD":
+		return scope == ScopeRead || scope == ScopeComplete
+	case scope == ScopeComplete:
+		return resource == "daily_chores" && id != 0 && (method == "PATCH" || method == "PUT")
+	}
+	return false
+}
+
+// withAPIScope returns r with the scope of its credentials attached
+func withAPIScope(r *http.Request, scope string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiScopeKey{}, scope))
+}
+
+// apiScope returns the scope of the request's credentials
+func apiScope(r *http.Request) string {
+	scope, _ := r.Context().Value(apiScopeKey{}).(string)
+	return scope
+}
+
+// tokensHandler lists the API tokens and shows the form to create one
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	renderTokensPage(w, "")
+}
+
+// renderTokensPage renders the tokens page, showing newToken if it was
+// just created
+func renderTokensPage(w http.ResponseWriter, newToken string) {
+	tokens, err := GetAPITokens(db)
+	if err != nil {
+		log.Printf("Error fetching API tokens: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	users, err := GetUsers(db)
+	if err != nil {
+		log.Printf("Error fetching users: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Tokens   []APIToken
+		Users    []User
+		NewToken string
+	}{
+		Tokens:   tokens,
+		Users:    users,
+		NewToken: newToken,
+	}
+	templates.ExecuteTemplate(w, "tokens.html", data)
+}
+
+// createTokenHandler creates an API token and shows it once
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Name the token after the script or device using it", http.StatusBadRequest)
+		return
+	}
+	scope := r.FormValue("scope")
+	if !validScope(scope) {
+		http.Error(w, "Invalid scope", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if user, err := GetUserByID(db, userID); err != nil || user.Archived {
+		http.Error(w, "Unknown user", http.StatusBadRequest)
+		return
+	}
+
+	token, err := CreateAPIToken(db, userID, name, scope)
+	if err != nil {
+		log.Printf("Error creating API token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderTokensPage(w, token)
+}
+
+// revokeTokenHandler revokes an API token
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("token_id"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+	err = RevokeAPIToken(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Token not found or already revoked", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking API token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/tokens", http.StatusFound)
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		scope    string
+		resource string
+		method   string
+		id       int
+		want     bool
+	}{
+		{ScopeFull, "users", "POST", 0, true},
+		{ScopeFull, "chores", "DELETE", 3, true},
+		{ScopeFull, "daily_chores", "PATCH", 3, true},
+
+		{ScopeRead, "users", "GET", 0, true},
+		{ScopeRead, "daily_chores", "HEAD", 3, true},
+		{ScopeRead, "daily_chores", "PATCH", 3, false},
+		{ScopeRead, "chores", "POST", 0, false},
+
+		{ScopeComplete, "chores", "GET", 0, true},
+		{ScopeComplete, "daily_chores", "PATCH", 3, true},
+		{ScopeComplete, "daily_chores", "PUT", 3, true},
+		{ScopeComplete, "daily_chores", "PATCH", 0, false},
+		{ScopeComplete, "daily_chores", "POST", 0, false},
+		{ScopeComplete, "daily_chores", "DELETE", 3, false},
+		{ScopeComplete, "chores", "PATCH", 3, false},
+		{ScopeComplete, "users", "PUT", 3, false},
+
+		{"", "users", "GET", 0, false},
+		{"admin", "users", "POST", 0, false},
+	}
+	for _, tt := range tests {
+		if got := scopeAllows(tt.scope, tt.resource, tt.method, tt.id); got != tt.want {
+			t.Errorf("scopeAllows(%q, %q, %q, %d) = %v, want %v", tt.scope, tt.resource, tt.method, tt.id, got, tt.want)
+		}
+	}
+}
@@ -17,7 +17,9 @@ CERT_PATH="${CERT_BASE_PATH}/fullchain.pem"
 KEY_PATH="${CERT_BASE_PATH}/privkey.pem"
 echo "looking for certificates in $CERT_PATH and $KEY_PATH".
 
-if [ ! -d "$CERT_BASE_PATH" ]; then
+if [ "$CHORES_ACME" = "true" ]; then
+  echo "The server manages its certificates itself. Skipping certbot."
+elif [ ! -d "$CERT_BASE_PATH" ]; then
   echo "Initial certbot setup"
   # Run certbot to *obtain* the certificates. Use full option names and environment variables.
   /opt/certbot/bin/certbot certonly \
@@ -47,31 +49,19 @@ else
     echo "Certificates already exist. Skipping initial Certbot run."
 fi
 
-# Originally wanted to run cert renewal via cron, but that can't run as non-root user
-# unless we use a non-standard cron :(
-# Since our scheduling needs are simple, we just run two loops:
-# --- DuckDNS Update Loop (runs in the background) ---
-(
+# Without CHORES_ACME, certbot renews the certificates: a background loop
+# checks twice a day, as cron can't run as a non-root user. The server
+# reloads renewed certificates by itself (see app/certs.go) and keeps the
+# DuckDNS record up to date (see app/dyndns.go).
+if [ "$CHORES_ACME" != "true" ]; then
+  (
     while true; do
-        /app/scripts/update_duckdns.sh >> /app/duckdns.log 2>&1
-	# TODO log errors
-        sleep 300  # Sleep for 5 minutes (300 seconds)
+      if ! /opt/certbot/bin/certbot renew --quiet --config-dir /app/certbot/config --work-dir /app/certbot/work --logs-dir /app/certbot/logs; then
+        logger -p user.err -t "certbot-renewal" "Certbot renewal failed!"
+      fi
+      sleep 43200  # Sleep for 12 hours
     done
-) &
-DUCKDNS_PID=$!
-
-# --- Certbot Renewal Loop (runs in the background) ---
-(
-    while true; do
-         /opt/certbot/bin/certbot renew --quiet --config-dir /app/certbot/config --work-dir /app/certbot/work --logs-dir /app/certbot/logs
-         # Check the exit code; if not 0, there might be an issue
-         if [ $? -ne 0 ]; then
-           logger -p user.err -t "certbot-renewal" "Certbot renewal failed!"
-           # TODO Consider exiting, or at least alerting somehow
-         fi
-        sleep 43200  # Sleep for 12 hours
-    done
-) &
-CERTBOT_PID=$!
+  ) &
+fi
 
 exec "$@"